@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The verbs which can be granted by an access rule
+var aclVerbs = []string{"list", "read", "upload", "delete", "copy", "move", "link", "share"}
+
+// An access rule from the ACL file.  A rule applies when the path matches,
+// the verb is listed and the caller is one of the users or in one of the
+// groups.  A rule without users and groups applies to everyone, including
+// anonymous callers, and the user "*" is any authenticated user.  A rule with
+// a host only applies to requests for that host, to tell apart the buckets
+// routed by Host which are mounted on the same path.
+type aclRule struct {
+	Name   string   `yaml:"name"`
+	Host   string   `yaml:"host"`
+	Path   string   `yaml:"path"`
+	Users  []string `yaml:"users"`
+	Groups []string `yaml:"groups"`
+	Verbs  []string `yaml:"verbs"`
+	Deny   bool     `yaml:"deny"`
+
+	re *regexp.Regexp
+}
+
+// The access rules, the first rule which applies decides and a request which
+// no rule applies to is denied.  The network rules are checked on top of them,
+// and a file with only network rules leaves the access to the login settings.
+type acl struct {
+	File     string       `yaml:"-"`
+	Rules    []*aclRule   `yaml:"rules"`
+	Networks networkRules `yaml:"networks"`
+}
+
+// Read and validate the ACL file
+func loadACL(file string) (*acl, error) {
+	dat, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	a := &acl{File: file}
+	dec := yaml.NewDecoder(bytes.NewReader(dat))
+	dec.KnownFields(true)
+	if err := dec.Decode(a); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	for i, r := range a.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if !strings.HasPrefix(r.Path, "/") {
+			return nil, fmt.Errorf("%s: %s: path %q must start with /", file, r.Name, r.Path)
+		}
+		if strings.Contains(r.Host, "/") {
+			return nil, fmt.Errorf("%s: %s: host %q is not a host name", file, r.Name, r.Host)
+		}
+		if len(r.Verbs) == 0 {
+			return nil, fmt.Errorf("%s: %s: no verbs given", file, r.Name)
+		}
+		for _, v := range r.Verbs {
+			if v != "*" && !contains(aclVerbs, v) {
+				return nil, fmt.Errorf("%s: %s: unknown verb %q, expected one of %s or *", file, r.Name, v, strings.Join(aclVerbs, ", "))
+			}
+		}
+		r.re = globRegexp(r.Path)
+	}
+	if err := a.Networks.check(file); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Convert a path glob to a regular expression.  A "*" matches within a path
+// segment, "**" matches across segments and a pattern ending in "/" matches
+// everything below it.
+func globRegexp(glob string) *regexp.Regexp {
+	var sb strings.Builder
+	sb.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case c == '*' && i+1 < len(glob) && glob[i+1] == '*':
+			sb.WriteString(".*")
+			i++
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	if strings.HasSuffix(glob, "/") {
+		sb.WriteString(".*")
+	}
+	sb.WriteString("$")
+	return regexp.MustCompile(sb.String())
+}
+
+// Does the host of a rule match the host of the request?  A rule without a
+// host matches them all.
+func hostMatch(ruleHost, host string) bool {
+	return ruleHost == "" || strings.EqualFold(ruleHost, host)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *aclRule) appliesTo(id *Identity) bool {
+	return memberOf(id, r.Users, r.Groups)
+}
+
+// Is the caller one of the users or in one of the groups?  Empty lists match
+// everyone and the user "*" is any authenticated user.
+func memberOf(id *Identity, users, groups []string) bool {
+	if len(users) == 0 && len(groups) == 0 {
+		return true
+	}
+	if id == nil {
+		return false
+	}
+	if contains(users, "*") || contains(users, id.User) {
+		return true
+	}
+	for _, g := range id.Groups {
+		if contains(groups, g) {
+			return true
+		}
+	}
+	return false
+}
+
+// Find the first rule which applies to the caller, verb, host and path, nil
+// when there is none.
+func (a *acl) match(id *Identity, host, verb, p string) *aclRule {
+	for _, r := range a.Rules {
+		if (contains(r.Verbs, verb) || contains(r.Verbs, "*")) && r.appliesTo(id) &&
+			hostMatch(r.Host, host) && r.re.MatchString(p) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Is the verb on the path of the host allowed for the caller?  The reason
+// names the rule which decided.
+func (a *acl) allowed(id *Identity, host, verb, p string) (bool, string) {
+	r := a.match(id, host, verb, p)
+	switch {
+	case r == nil:
+		return false, fmt.Sprintf("no rule allows %s on %s", verb, p)
+	case r.Deny:
+		return false, fmt.Sprintf("%s on %s denied by %q", verb, p, r.Name)
+	}
+	return true, ""
+}
+
+// Is the verb on the path denied to the caller by a rule?  Requests with a
+// share link are held to these, the rest of the rules were checked for the
+// user who minted the link.
+func (a *acl) denied(id *Identity, host, verb, p string) (bool, string) {
+	if a == nil {
+		return false, ""
+	}
+	if r := a.match(id, host, verb, p); r != nil && r.Deny {
+		return true, fmt.Sprintf("%s on %s denied by %q", verb, p, r.Name)
+	}
+	return false, ""
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestACLHosts(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "acl.yaml")
+	os.WriteFile(file, []byte(`
+rules:
+  - name: docs-upload
+    host: Docs.Example.com
+    path: /**
+    users: [alice]
+    verbs: [upload]
+  - name: docs-read
+    host: docs.example.com
+    path: /**
+    verbs: [read]
+  - name: private
+    path: /**
+    users: [bob]
+    verbs: [read, upload]
+`), 0600)
+	a, err := loadACL(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob := &Identity{User: "alice"}, &Identity{User: "bob"}
+	tests := []struct {
+		id            *Identity
+		host, verb, p string
+		ok            bool
+	}{
+		{nil, "docs.example.com", "read", "/guide.html", true},
+		{nil, "files.example.com", "read", "/guide.html", false},
+		{alice, "docs.example.com", "upload", "/guide.html", true},
+		{alice, "DOCS.example.com", "upload", "/guide.html", true},
+		{alice, "files.example.com", "upload", "/guide.html", false},
+		{bob, "files.example.com", "upload", "/report.pdf", true},
+		{bob, "docs.example.com", "read", "/report.pdf", true},
+	}
+	for _, tt := range tests {
+		if ok, why := a.allowed(tt.id, tt.host, tt.verb, tt.p); ok != tt.ok {
+			t.Errorf("%v %s %s%s: got %v (%s)", tt.id, tt.verb, tt.host, tt.p, ok, why)
+		}
+	}
+
+	os.WriteFile(file, []byte("rules:\n  - path: /**\n    host: docs.example.com/x\n    verbs: [read]\n"), 0600)
+	if _, err := loadACL(file); err == nil {
+		t.Error("a host with a path was accepted")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/valyala/fasthttp"
+)
+
+// The admin handler is served on a separate listener so the paths here can
+// never collide with the objects in the bucket.
+func adminHandler(ctx *fasthttp.RequestCtx) {
+	ctx.Response.Header.Set("Cache-Control", "no-cache")
+	switch b2s(ctx.Path()) {
+	case "/healthz":
+		health(ctx)
+
+	case "/readyz":
+		for _, b := range buckets {
+			if ok, why := b.ready(); !ok {
+				ctx.Error("not ready: bucket "+b.Name+": "+why+"\n", fasthttp.StatusServiceUnavailable)
+				return
+			}
+		}
+		ctx.WriteString("ready\n")
+
+	case "/reload":
+		if !ctx.IsPost() && !ctx.IsPut() {
+			ctx.Error("405 method not allowed: "+b2s(ctx.Method()), fasthttp.StatusMethodNotAllowed)
+			return
+		}
+		if err := reload(); err != nil {
+			log.Println("Reload failed, keeping the current configuration:", err)
+			ctx.Error("reload failed: "+err.Error()+"\n", fasthttp.StatusUnprocessableEntity)
+			return
+		}
+		ctx.WriteString("reloaded\n")
+
+	case "/quota":
+		quotaReport(ctx)
+
+	default:
+		ctx.Error("404 not found", fasthttp.StatusNotFound)
+	}
+}
+
+type bucketHealth struct {
+	Bucket      string
+	Path        string
+	Host        string `json:",omitempty"`
+	RoleARN     string `json:",omitempty"`
+	Credentials credStatus
+	Objects     int64
+	Size        int64
+	Ready       bool
+	Error       string `json:",omitempty"`
+}
+
+// Report the state of each bucket, including the credentials and the assumed
+// role identity.
+func health(ctx *fasthttp.RequestCtx) {
+	status := struct {
+		Status  string
+		Version string
+		Buckets []bucketHealth
+	}{Status: "ok", Version: Version}
+
+	for _, b := range buckets {
+		h := bucketHealth{Bucket: b.Name, Path: b.Path, Host: b.Host, RoleARN: b.RoleARN,
+			Credentials: b.credStatus(), Objects: b.dir.count, Size: b.dir.size}
+		var why string
+		h.Ready, why = b.ready()
+		if b.dirError != nil {
+			h.Error = b.dirError.Error()
+		} else if !h.Ready {
+			h.Error = why
+		}
+		if h.Error != "" {
+			status.Status = "error"
+		}
+		status.Buckets = append(status.Buckets, h)
+	}
+
+	ctx.SetContentType("application/json")
+	if status.Status != "ok" {
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+	}
+	enc := json.NewEncoder(ctx)
+	enc.SetIndent("", "  ")
+	enc.Encode(status)
+}
+
+func serveAdmin(addr string) {
+	s := &fasthttp.Server{
+		Handler: adminHandler,
+		Name:    "Bucket-HTTP-Proxy (github.com/pschou/bucket-http-proxy)",
+	}
+	log.Printf("Listening for admin connections on %s", addr)
+	if err := s.ListenAndServe(addr); err != nil {
+		log.Printf("Admin error: %s", err)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// One line of the audit log, written for every request which tries to modify
+// a bucket, whether it was allowed or not.
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	IP       string    `json:"ip"`
+	User     string    `json:"user,omitempty"`
+	Auth     string    `json:"auth,omitempty"`
+	Groups   []string  `json:"groups,omitempty"`
+	Action   string    `json:"action"`
+	Bucket   string    `json:"bucket,omitempty"`
+	Key      string    `json:"key,omitempty"`
+	Source   string    `json:"source,omitempty"`
+	Bytes    int64     `json:"bytes,omitempty"`
+	Checksum string    `json:"checksum,omitempty"`
+	Status   int       `json:"status"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Start an audit entry for a request which modifies the bucket, nil for
+// requests which only read.
+func newAuditEntry(ctx *fasthttp.RequestCtx, method string) *auditEntry {
+	var action string
+	switch method {
+	case "POST", "PATCH":
+		action = "upload"
+		if method == "POST" && isExtract(ctx) {
+			action = "extract"
+		}
+	case "DELETE":
+		action = "delete"
+		if ctx.QueryArgs().Has("tus") {
+			action = "abort-upload"
+		}
+	case "PUT":
+		action = strings.ToLower(strings.SplitN(b2s(ctx.Request.Header.Peek("Action")), " ", 2)[0])
+		switch action {
+		case "tea":
+			return nil
+		case "":
+			action = "put"
+		}
+	default:
+		return nil
+	}
+	a := &auditEntry{Time: time.Now().UTC(), IP: clientIP(ctx).String(), Action: action}
+	ctx.SetUserValue("audit", a)
+	return a
+}
+
+func (a *auditEntry) setIdentity(id *Identity) {
+	if id != nil {
+		a.User, a.Auth, a.Groups = id.User, id.Method, id.Groups
+	}
+}
+
+// The audit log, a file of JSON lines which is rotated by size and age.  The
+// rotated files can be mirrored into a path served by the proxy.
+type auditWriter struct {
+	file       string
+	maxSize    int64
+	maxAge     time.Duration
+	mirrorPath string
+
+	mutex  sync.Mutex
+	out    io.Writer
+	f      *os.File
+	size   int64
+	opened time.Time
+	retry  time.Time // When to try again after a failed rotation
+}
+
+var auditLog *auditWriter
+
+// Renames the audit log aside, replaced when testing a failed rotation
+var auditRename = os.Rename
+
+func newAuditWriter(file string, maxSize int64, maxAge time.Duration, mirrorPath string) (*auditWriter, error) {
+	w := &auditWriter{file: file, maxSize: maxSize, maxAge: maxAge, mirrorPath: mirrorPath}
+	if file == "-" {
+		w.out = os.Stdout
+		return w, nil
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	if maxAge > 0 {
+		go func() {
+			for range time.Tick(time.Minute) {
+				w.mutex.Lock()
+				w.rotateIfNeeded()
+				w.mutex.Unlock()
+			}
+		}()
+	}
+	return w, nil
+}
+
+func (w *auditWriter) open() error {
+	f, err := os.OpenFile(w.file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.out, w.size, w.opened = f, f, st.Size(), time.Now()
+	return nil
+}
+
+// Move the current file aside when it is too big or too old, and open a new
+// one.  Must be called with the mutex held.
+func (w *auditWriter) rotateIfNeeded() {
+	if w.f == nil || w.size == 0 || time.Now().Before(w.retry) ||
+		!((w.maxSize > 0 && w.size >= w.maxSize) || (w.maxAge > 0 && time.Since(w.opened) >= w.maxAge)) {
+		return
+	}
+	rotated := w.file + "." + time.Now().UTC().Format("20060102T150405Z")
+	for i := 1; ; i++ {
+		// Don't overwrite a file rotated within the same second
+		if _, err := os.Stat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = fmt.Sprintf("%s.%s-%d", w.file, time.Now().UTC().Format("20060102T150405Z"), i)
+	}
+	if err := auditRename(w.file, rotated); err != nil && !os.IsNotExist(err) {
+		// Reopening would only append to the same file, keep writing to it
+		// and try again in a minute
+		log.Println("Error rotating audit log:", err)
+		w.retry = time.Now().Add(time.Minute)
+		return
+	}
+	w.f.Close()
+	if err := w.open(); err != nil {
+		log.Println("Error opening audit log:", err)
+		w.f, w.out = nil, os.Stderr
+		return
+	}
+	if w.mirrorPath != "" {
+		go mirrorAuditLog(rotated, w.mirrorPath)
+	}
+}
+
+func (w *auditWriter) write(a *auditEntry) {
+	line, err := json.Marshal(a)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.rotateIfNeeded()
+	n, err := w.out.Write(line)
+	w.size += int64(n)
+	if err != nil {
+		log.Println("Error writing audit log:", err)
+	}
+}
+
+// Upload a rotated audit log into the bucket mounted on the mirror path.
+func mirrorAuditLog(file, mirrorPath string) {
+	b, uri := routeBucket("", mirrorPath+filepath.Base(file))
+	if b == nil {
+		log.Printf("Error mirroring audit log: no bucket is mounted on %s", mirrorPath)
+		return
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		log.Println("Error mirroring audit log:", err)
+		return
+	}
+	defer f.Close()
+	if err := b.UploadFile(uri, f); err != nil {
+		log.Println("Error mirroring audit log:", err)
+		return
+	}
+	log.Printf("Mirrored audit log %s to %s/%s", file, b.Name, b.key(uri))
+}
+
+// Write the audit entry, if any, once the request has been handled.
+func auditRequests(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		h(ctx)
+		if a, ok := ctx.UserValue("audit").(*auditEntry); ok && auditLog != nil {
+			a.Status = ctx.Response.StatusCode()
+			if a.Status >= 400 {
+				a.Error = strings.TrimSpace(string(ctx.Response.Body()))
+				if len(a.Error) > 200 {
+					a.Error = a.Error[:200]
+				}
+			}
+			auditLog.write(a)
+		}
+	}
+}
+
+// Parse a size like "100M" or "1G" into bytes
+func parseSize(v string) (int64, error) {
+	if v == "" {
+		return 0, fmt.Errorf("expected a size like 100M")
+	}
+	mult := int64(1)
+	switch strings.ToUpper(v[len(v)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		v = v[:len(v)-1]
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("expected a size like 100M")
+	}
+	return n * mult, nil
+}
+
+func checkSize(v string) error {
+	_, err := parseSize(v)
+	return err
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditRotation(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "audit.log")
+	w, err := newAuditWriter(file, 300, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &auditEntry{Time: time.Now().UTC(), IP: "192.0.2.1", Action: "upload", Bucket: "b", Key: strings.Repeat("k", 100), Status: 201}
+
+	// Over the size the file is moved aside before the next entry
+	w.write(entry)
+	w.write(entry)
+	w.write(entry)
+	rotated, _ := filepath.Glob(file + ".*")
+	if len(rotated) != 1 {
+		t.Fatalf("expected one rotated file, got %v", rotated)
+	}
+
+	// A failed rename keeps appending to the file, without reopening it
+	auditRename = func(string, string) error { return errors.New("read-only file system") }
+	defer func() { auditRename = os.Rename }()
+	before := w.f
+	w.write(entry)
+	w.write(entry)
+	if w.f != before || !w.retry.After(time.Now()) {
+		t.Error("the audit log was reopened after a failed rotation")
+	}
+	if st, _ := os.Stat(file); st.Size() != w.size || w.size < 400 {
+		t.Errorf("entries were lost, the file has %d bytes and %d were written", st.Size(), w.size)
+	}
+
+	// It is tried again once the retry time passes
+	auditRename = os.Rename
+	w.retry = time.Time{}
+	w.write(entry)
+	if rotated, _ = filepath.Glob(file + ".*"); len(rotated) != 2 {
+		t.Errorf("expected two rotated files, got %v", rotated)
+	}
+}
+
+func TestAuditMaxAgeZero(t *testing.T) {
+	for _, tt := range []struct {
+		age string
+		ok  bool
+	}{{"0", true}, {"24h", true}, {"-1h", false}, {"soon", false}} {
+		t.Setenv("AUDIT_MAX_AGE", tt.age)
+		_, errs := loadConfig("")
+		var found bool
+		for _, err := range errs {
+			found = found || strings.Contains(err.Error(), "AUDIT_MAX_AGE")
+		}
+		if found == tt.ok {
+			t.Errorf("AUDIT_MAX_AGE=%s: errors %v", tt.age, errs)
+		}
+	}
+}
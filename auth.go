@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/netip"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Who is making a request, as established by one of the authentication
+// methods.  A nil identity is an anonymous request.
+type Identity struct {
+	User   string
+	Groups []string
+	Method string // How the user was authenticated, like "basic", "proxy" or "header"
+}
+
+func (id *Identity) String() string {
+	if id == nil {
+		return "anonymous"
+	}
+	return id.User + " (" + id.Method + ")"
+}
+
+// Work out who is making the request.  Credentials which are given but do not
+// check out return false, so the client can be challenged instead of being
+// silently treated as anonymous.
+func authenticate(ctx *fasthttp.RequestCtx, ls *liveSettings) (*Identity, bool) {
+	if token, ok := bearerToken(ctx); ok && ls.jwt != nil {
+		id, err := ls.jwt.authenticate(token)
+		if err != nil {
+			log.Printf("Token rejected from %s: %v", clientIP(ctx), err)
+			return nil, false
+		}
+		return id, true
+	}
+	if user, pass, ok := basicAuth(ctx); ok && ls.htpasswd != nil {
+		if !ls.htpasswd.authenticate(user, pass) {
+			log.Printf("Authentication failed for %q from %s", user, clientIP(ctx))
+			return nil, false
+		}
+		return &Identity{User: user, Method: "basic"}, true
+	}
+
+	// A client certificate which was verified against TLS_CLIENT_CA_FILE
+	if state := ctx.TLSConnectionState(); state != nil && len(state.VerifiedChains) > 0 {
+		if id := certIdentity(state.PeerCertificates[0], ls.certUser); id != nil {
+			return id, true
+		}
+	}
+
+	// The user and groups logged in by a trusted reverse proxy.  Only the proxy
+	// connecting to us is trusted, not the addresses it forwards for.
+	if ls.forwardedUser != "" {
+		if user := ctx.Request.Header.Peek(ls.forwardedUser); len(user) > 0 {
+			peer, _ := netip.AddrFromSlice(ctx.RemoteIP())
+			if ls.trustedProxies.contains(peer) {
+				id := &Identity{User: string(user), Method: "proxy"}
+				if ls.forwardedGroups != "" {
+					id.Groups = strings.FieldsFunc(string(ctx.Request.Header.Peek(ls.forwardedGroups)), splitList)
+				}
+				return id, true
+			}
+			log.Printf("Ignoring %s from %s, it is not a trusted proxy", ls.forwardedUser, peer)
+		}
+	}
+
+	// The header set by a reverse proxy.  Next to the logins it would let any
+	// client pick a user, so then it is only taken from the trusted proxies.
+	if len(ls.uploadHeader) > 0 {
+		if user := ctx.Request.Header.Peek(ls.uploadHeader); len(user) > 0 {
+			peer, _ := netip.AddrFromSlice(ctx.RemoteIP())
+			if !ls.authEnabled() || ls.trustedProxies.contains(peer) {
+				return &Identity{User: string(user), Method: "header"}, true
+			}
+			log.Printf("Ignoring %s from %s, it is not a trusted proxy", ls.uploadHeader, peer)
+		}
+	}
+	return nil, true
+}
+
+// The identity established for the request by the handler
+func identity(ctx *fasthttp.RequestCtx) *Identity {
+	id, _ := ctx.UserValue("identity").(*Identity)
+	return id
+}
+
+// Parse the token out of a Bearer Authorization header
+func bearerToken(ctx *fasthttp.RequestCtx) (string, bool) {
+	auth := b2s(ctx.Request.Header.Peek("Authorization"))
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(auth[7:]), true
+}
+
+// Parse the user and password out of a Basic Authorization header
+func basicAuth(ctx *fasthttp.RequestCtx) (user, pass string, ok bool) {
+	auth := b2s(ctx.Request.Header.Peek("Authorization"))
+	if len(auth) < 6 || !strings.EqualFold(auth[:6], "Basic ") {
+		return
+	}
+	dat, err := base64.StdEncoding.DecodeString(strings.TrimSpace(auth[6:]))
+	if err != nil {
+		return
+	}
+	return strings.Cut(string(dat), ":")
+}
+
+// Ask the client to log in with the configured methods
+func challenge(ctx *fasthttp.RequestCtx, ls *liveSettings) {
+	ctx.Error("401 unauthorized", fasthttp.StatusUnauthorized)
+	if ls.jwt != nil {
+		ctx.Response.Header.Add("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", ls.authRealm))
+	}
+	if ls.htpasswd != nil {
+		ctx.Response.Header.Add("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", ls.authRealm))
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// A request from the address with the headers, name and value in turn
+func testRequest(addr string, headers ...string) *fasthttp.RequestCtx {
+	var req fasthttp.Request
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(&req, &net.TCPAddr{IP: net.ParseIP(addr), Port: 40000}, nil)
+	return ctx
+}
+
+func TestModifyHeaderWithLogins(t *testing.T) {
+	proxies, _ := parsePrefixes([]string{"10.0.0.5"})
+	users := filepath.Join(t.TempDir(), "htpasswd")
+	os.WriteFile(users, []byte("alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600)
+	plain := &liveSettings{uploadHeader: "X-USER", trustedProxies: proxies}
+	logins := &liveSettings{uploadHeader: "X-USER", trustedProxies: proxies, htpasswd: newHtpasswd(users)}
+
+	tests := []struct {
+		name string
+		ls   *liveSettings
+		addr string
+		user string
+	}{
+		{"no logins, any client", plain, "192.0.2.1", "mallory"},
+		{"no logins, trusted proxy", plain, "10.0.0.5", "mallory"},
+		{"logins, untrusted client", logins, "192.0.2.1", ""},
+		{"logins, trusted proxy", logins, "10.0.0.5", "mallory"},
+	}
+	for _, tt := range tests {
+		live.Store(tt.ls)
+		id, ok := authenticate(testRequest(tt.addr, "X-USER", "mallory"), tt.ls)
+		if !ok || (id == nil) != (tt.user == "") || (id != nil && id.User != tt.user) {
+			t.Errorf("%s: got %v %v, expected %q", tt.name, id, ok, tt.user)
+		}
+	}
+	live.Store(nil)
+}
+
+func TestModifyHeaderNeedsTrustedProxies(t *testing.T) {
+	users := filepath.Join(t.TempDir(), "htpasswd")
+	os.WriteFile(users, []byte("alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600)
+	tests := []struct {
+		header, htpasswd, proxies string
+		proxyProtocol             bool
+		ok                        bool
+	}{
+		{"X-USER", "", "", false, true},
+		{"X-USER", users, "", false, false},
+		{"X-USER", users, "10.0.0.5", false, true},
+		{"", users, "", false, true},
+		{"", "", "", true, false},
+		{"", "", "10.0.0.5", true, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("MODIFY_ALLOW_HEADER", tt.header)
+		t.Setenv("PROXY_PROTOCOL", strconv.FormatBool(tt.proxyProtocol))
+		t.Setenv("HTPASSWD_FILE", tt.htpasswd)
+		t.Setenv("TRUSTED_PROXIES", tt.proxies)
+		_, errs := loadConfig("")
+		var found bool
+		for _, err := range errs {
+			found = found || strings.Contains(err.Error(), "needs TRUSTED_PROXIES")
+		}
+		if found == tt.ok {
+			t.Errorf("%+v: errors %v", tt, errs)
+		}
+	}
+}
+
+// Known answers from crypt(3), openssl passwd and the examples of the SHA-crypt
+// spec by Ulrich Drepper
+func TestHtpasswdHashes(t *testing.T) {
+	long := "a much longer password that goes past one sha512 digest of sixty-four bytes"
+	tests := []struct {
+		setting, pass, hash string
+	}{
+		{"$5$saltstring", "Hello world!", "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"},
+		{"$5$rounds=10000$saltstringsaltstring", "Hello world!", "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA"},
+		{"$5$rounds=5000$toolongsaltstring", "This is just a test", "$5$rounds=5000$toolongsaltstrin$Un/5jzAHMgOGZ5.mWJpuVolil07guHPvOW8mGRcvxa5"},
+		{"$5$rounds=10$roundstoolow", "x", "$5$rounds=1000$roundstoolow$Jc4xA6.bl9C.Nqoe./MktmYeUpkKvVSABfG6yGhgjM0"},
+		{"$5$saltstring", long, "$5$saltstring$uifHVk8zN3ajfEGaZDymNQalvBiNcf6W/ijbnv5GtvB"},
+		{"$5$", "empty salt", "$5$$qu3REWa/3sl1BuquQ3B23Cna49jUWzQNbVo5saPx3d1"},
+		{"$6$saltstring", "Hello world!", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"$6$rounds=10000$saltstringsaltstring", "Hello world!", "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+		{"$6$rounds=1000$short", "x", "$6$rounds=1000$short$OcyCC7WtUReIOT8ORK5pUhNxYIwUN0LakZfYfzAxTg7SpeLqXz0zTUDorrk/BkgMFz5rM/jCwDRTi/2WclkE/."},
+		{"$6$saltstring", long, "$6$saltstring$jLoCifJKOZ7s5PJpyMzW7LF.0/rHDfK/4DpiHsw5XfKJuctFmWRY5LPuY6l/Y0mJDGrEU0JvAj8Vf1NzdheVn/"},
+		{"$apr1$r31....", "password", "$apr1$r31....$kMmt8Ia8qcWk4vKKEhpgx1"},
+		{"$apr1$saltstri", "Hello world!", "$apr1$saltstri$aGfuB7Lcvs2TUeFTqUVfN0"},
+		{"$apr1$Ab3.x/Zq", long, "$apr1$Ab3.x/Zq$N3Ucyv4urYvy6LbH0mRbx."},
+		{"$apr1$a", "", "$apr1$a$lsAcX0kKaMIVmrCtUuk5b0"},
+		{"", "password", "$2y$05$abcdefghijklmnopqrstuuWG29KuyeAicPCJODk1zjyGvyQUU2awu"},
+		{"", "password", "$2b$10$N9qo8uLOickgx2ZMRZoMye8fOsiTWZqYtkxvXkKm8BMzjT7t/vIdq"},
+		{"", "password", "{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="},
+	}
+	for _, tt := range tests {
+		var got string
+		switch {
+		case strings.HasPrefix(tt.setting, "$5$"):
+			got = shaCrypt(sha256.New, tt.setting, tt.pass)
+		case strings.HasPrefix(tt.setting, "$6$"):
+			got = shaCrypt(sha512.New, tt.setting, tt.pass)
+		case strings.HasPrefix(tt.setting, "$apr1$"):
+			got = apr1Crypt(tt.setting, tt.pass)
+		}
+		if tt.setting != "" && got != tt.hash {
+			t.Errorf("%s with %q: got %s, expected %s", tt.setting, tt.pass, got, tt.hash)
+		}
+		if !checkHash(tt.hash, tt.pass) {
+			t.Errorf("%s did not check out with %q", tt.hash, tt.pass)
+		}
+		if checkHash(tt.hash, tt.pass+"x") {
+			t.Errorf("%s checked out with the wrong password", tt.hash)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/valyala/fasthttp"
+)
+
+// A bucket mounted into the proxy.  Requests are routed to a bucket by the
+// path prefix it is mounted on and, optionally, by the Host header.
+type Bucket struct {
+	Name   string `json:"bucket"`
+	Path   string `json:"path"`   // URL path the bucket is mounted on, like "/releases/"
+	Host   string `json:"host"`   // Only match requests for this host name
+	Prefix string `json:"prefix"` // Serve only the keys under this prefix of the bucket
+	Region string `json:"region"`
+
+	// Credentials for this bucket, when none are given the credential chain is used
+	Profile         string `json:"profile"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+	SessionToken    string `json:"session_token"`
+
+	// Assume this role, with the credentials above, to access the bucket
+	RoleARN     string `json:"role_arn"`
+	ExternalID  string `json:"external_id"`
+	SessionName string `json:"session_name"`
+
+	// The client is swapped out on each credential refresh while requests are
+	// using it, so it is only accessed with S3()
+	client atomic.Pointer[s3.Client]
+
+	// The state of the credentials from the last refresh
+	creds      credStatus
+	credsMutex sync.Mutex
+
+	// The directory index of the bucket
+	dir       Root
+	dirLock   sync.RWMutex
+	dirError  error
+	dirUpdate time.Time
+	dirListed time.Time // When the listing for the index was started
+
+	// The uploads since the index was listed, for the quota usage
+	recent      []recentUpload
+	recentMutex sync.Mutex
+
+	// Cache of the checksums from the object heads
+	hashCache      map[string]hashdat
+	hashCacheMutex sync.Mutex
+}
+
+var buckets []*Bucket
+
+// Parse the buckets section of the config file.
+func parseBuckets(val interface{}) ([]*Bucket, error) {
+	dat, err := json.Marshal(val)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(strings.NewReader(b2s(dat)))
+	dec.DisallowUnknownFields()
+	var list []*Bucket
+	if err := dec.Decode(&list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// Validate the bucket routes and normalize the paths.
+func checkBuckets(list []*Bucket) (errs []error) {
+	seen := make(map[string]int)
+	for i, b := range list {
+		if b.Name == "" {
+			errs = append(errs, fmt.Errorf("buckets[%d]: bucket name is required", i))
+		}
+		if b.Path == "" {
+			b.Path = "/"
+		}
+		if b.Path[0] != '/' {
+			b.Path = "/" + b.Path
+		}
+		if !slashed(b.Path) {
+			b.Path += "/"
+		}
+		if err := checkPrefix(b.Prefix); err != nil {
+			errs = append(errs, fmt.Errorf("buckets[%d]: prefix %q %w", i, b.Prefix, err))
+		}
+		if b.Prefix != "" && !slashed(b.Prefix) {
+			b.Prefix += "/"
+		}
+		if (b.AccessKeyID == "") != (b.SecretAccessKey == "") {
+			errs = append(errs, fmt.Errorf("buckets[%d]: access_key_id and secret_access_key must be set together", i))
+		}
+		if b.RoleARN == "" && (b.ExternalID != "" || b.SessionName != "") {
+			errs = append(errs, fmt.Errorf("buckets[%d]: external_id and session_name need a role_arn", i))
+		} else if b.RoleARN != "" && !strings.HasPrefix(b.RoleARN, "arn:") {
+			errs = append(errs, fmt.Errorf("buckets[%d]: role_arn %q is not an ARN", i, b.RoleARN))
+		}
+		route := strings.ToLower(b.Host) + b.Path
+		if j, ok := seen[route]; ok {
+			errs = append(errs, fmt.Errorf("buckets[%d]: route %q is already used by buckets[%d]", i, route, j))
+		}
+		seen[route] = i
+	}
+	return
+}
+
+// Setup the buckets to be served and sort them so the most specific route is
+// matched first.
+func setBuckets(list []*Bucket) {
+	for _, b := range list {
+		b.hashCache = make(map[string]hashdat)
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if len(list[i].Path) != len(list[j].Path) {
+			return len(list[i].Path) > len(list[j].Path)
+		}
+		return list[i].Host != "" && list[j].Host == ""
+	})
+	buckets = list
+}
+
+// Create the S3 client for the bucket, layering the bucket specific region and
+// credentials on the base config.
+func (b *Bucket) connect(ctx context.Context, base aws.Config) error {
+	cfg := base.Copy()
+	if b.Profile != "" {
+		var err error
+		cfg, err = config.LoadDefaultConfig(ctx, config.WithSharedConfigProfile(b.Profile))
+		if err != nil {
+			return err
+		}
+		if cfg.Region == "" {
+			cfg.Region = base.Region
+		}
+	}
+	if b.AccessKeyID != "" {
+		cfg.Credentials = aws.NewCredentialsCache(credentials.NewStaticCredentialsProvider(
+			b.AccessKeyID, b.SecretAccessKey, b.SessionToken))
+	}
+	if b.Region != "" {
+		cfg.Region = b.Region
+	}
+	if b.RoleARN != "" {
+		// Layer the assumed role on the base provider, the cache refreshes the
+		// session before it expires.
+		stsClient := sts.NewFromConfig(cfg)
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(stsClient, b.RoleARN,
+			func(o *stscreds.AssumeRoleOptions) {
+				if b.ExternalID != "" {
+					o.ExternalID = aws.String(b.ExternalID)
+				}
+				if b.SessionName != "" {
+					o.RoleSessionName = b.SessionName
+				}
+			}))
+
+	}
+
+	// Make sure the credentials work before swapping in the new client
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return err
+	}
+	var identity string
+	if b.RoleARN != "" {
+		id, err := sts.NewFromConfig(cfg).GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+		if err != nil {
+			return fmt.Errorf("assume role %s: %w", b.RoleARN, err)
+		}
+		identity = aws.ToString(id.Arn)
+	}
+	b.client.Store(newS3Client(cfg))
+
+	b.credsMutex.Lock()
+	defer b.credsMutex.Unlock()
+	b.creds = credStatus{Source: creds.Source, Identity: identity, Refreshed: time.Now()}
+	if creds.CanExpire {
+		b.creds.Expires = &creds.Expires
+	}
+	return nil
+}
+
+// The S3 client for the bucket, which is replaced on each credential refresh.
+func (b *Bucket) S3() *s3.Client {
+	return b.client.Load()
+}
+
+// The state of the bucket credentials, as reported by the health endpoints.
+type credStatus struct {
+	Source    string     `json:",omitempty"`
+	Identity  string     `json:",omitempty"` // The ARN of the assumed role session
+	Expires   *time.Time `json:",omitempty"`
+	Refreshed time.Time  `json:",omitempty"`
+	Failures  int        `json:",omitempty"` // Number of refreshes which failed in a row
+	LastError string     `json:",omitempty"`
+}
+
+// How many credential refreshes may fail in a row before the proxy reports it
+// is not ready.
+var refreshFailLimit = 3
+
+// Record a failed credential refresh, the last working client is kept.
+func (b *Bucket) refreshFailed(err error) {
+	b.credsMutex.Lock()
+	defer b.credsMutex.Unlock()
+	b.creds.Failures++
+	b.creds.LastError = err.Error()
+	log.Printf("Credential refresh for bucket %s failed (%d in a row): %v", b.Name, b.creds.Failures, err)
+	if b.creds.Failures == refreshFailLimit {
+		log.Printf("Bucket %s is not ready, the credentials have not refreshed %d times", b.Name, b.creds.Failures)
+	}
+}
+
+func (b *Bucket) credStatus() credStatus {
+	b.credsMutex.Lock()
+	defer b.credsMutex.Unlock()
+	return b.creds
+}
+
+// Is the bucket ready to serve requests?  If not, the reason is returned.
+func (b *Bucket) ready() (bool, string) {
+	cs := b.credStatus()
+	switch {
+	case b.S3() == nil:
+		return false, "no client"
+	case cs.Expires != nil && time.Now().After(*cs.Expires):
+		return false, "credentials expired at " + cs.Expires.UTC().Format(time.RFC1123)
+	case cs.Failures >= refreshFailLimit:
+		return false, fmt.Sprintf("%d credential refreshes failed: %s", cs.Failures, cs.LastError)
+	}
+	return true, ""
+}
+
+// The bucket key for a path relative to the mount point.
+func (b *Bucket) key(uri string) string {
+	return b.Prefix + uri
+}
+
+// Is the path relative to the mount point free of ".." segments which could
+// reach outside of the key prefix?
+func validPath(uri string) bool {
+	for _, part := range strings.Split(uri, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// Resolve the source of a copy, move or link action to a path relative to the
+// mount point.  Sources are either absolute from the mount point ("/dir/file")
+// or relative to the destination ("./file", "../dir/file"), and may not
+// escape the key prefix.
+func resolveSource(uri, src string) (string, error) {
+	var p string
+	switch {
+	case strings.HasPrefix(src, "/"):
+		p = path.Clean(src[1:])
+	case strings.HasPrefix(src, "."):
+		d, _ := path.Split(uri)
+		p = path.Clean(d + src)
+	default:
+		return "", fmt.Errorf("source %q is not relative or absolute", src)
+	}
+	if p == "." || p == ".." || strings.HasPrefix(p, "../") {
+		return "", fmt.Errorf("source %q is outside of the served path", src)
+	}
+	return p, nil
+}
+
+// The host of a Host header, without the port
+func hostName(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// Find the bucket for the request and the path relative to where the bucket
+// is mounted.
+func routeBucket(host, reqPath string) (*Bucket, string) {
+	host = hostName(host)
+	for _, b := range buckets {
+		if b.Host != "" && !strings.EqualFold(b.Host, host) {
+			continue
+		}
+		if strings.HasPrefix(reqPath, b.Path) {
+			return b, strings.TrimPrefix(reqPath, b.Path)
+		} else if reqPath+"/" == b.Path {
+			// The mount point without the trailing slash
+			return b, ""
+		}
+	}
+	return nil, ""
+}
+
+// The size and object count of the whole index, without racing a listing
+func (b *Bucket) dirTotals() (int64, int64) {
+	b.dirLock.RLock()
+	defer b.dirLock.RUnlock()
+	return b.dir.size, b.dir.count
+}
+
+// List the buckets which are mounted for the host, used when nothing is
+// mounted on the root path.
+func mountList(ctx *fasthttp.RequestCtx, host string, visible func(p string, isDir bool) bool) {
+	host = hostName(host)
+	var mounts []*Bucket
+	for _, b := range buckets {
+		if (b.Host == "" || strings.EqualFold(b.Host, host)) && (visible == nil || visible(b.Path, true)) {
+			mounts = append(mounts, b)
+		}
+	}
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].Path < mounts[j].Path })
+
+	if accept := strings.SplitN(b2s(ctx.Request.Header.Peek("Accept")), ",", 2); accept[0] == "list/json" {
+		ctx.Write([]byte("{\"/\":\n["))
+		encoder := json.NewEncoder(ctx)
+		for i, b := range mounts {
+			if i > 0 {
+				ctx.Write([]byte(","))
+			}
+			size, count := b.dirTotals()
+			encoder.Encode(DirItem{Name: strings.TrimPrefix(b.Path, "/"), Size: size, Count: count})
+		}
+		ctx.Write([]byte("]}"))
+		return
+	}
+
+	ctx.Response.Header.Set("Content-Type", "text/html;charset=UTF-8")
+	fmt.Fprintf(ctx, `<!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 3.2 Final//EN">
+<html>
+ <head>
+  <title>Index of /</title>
+	<style>
+body { font-family:arial,sans-serif;line-height:normal; }
+#entries { font-family: monospace, monospace; }
+  </style>
+ </head>
+ <body>
+ <h1>Index of /</h1>
+ <table id="entries">
+  <tr><th>Name</th><th>Bucket</th></tr>
+  <tr><th colspan="2"><hr></th></tr>
+`)
+	for _, b := range mounts {
+		name := html.EscapeString(strings.TrimPrefix(b.Path, "/"))
+		fmt.Fprintf(ctx, `  <tr><td><a href="%s">%s</a></td><td>&nbsp; %s</td></tr>
+`, name, name, html.EscapeString(b.Name+"/"+b.Prefix))
+	}
+	fmt.Fprintf(ctx, `  <tr><td colspan="2" align="right" style='font-size: xx-small;'><hr><em>Index built with Bucket-HTTP-Proxy (<a href="https://github.com/pschou/bucket-http-proxy">github.com/pschou/bucket-http-proxy</a>)</em></th></tr>
+ </table>
+ </body>
+</html>`)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestMountListEscapes(t *testing.T) {
+	saved := buckets
+	defer func() { buckets = saved }()
+	buckets = []*Bucket{
+		{Name: "plain", Path: "/plain/"},
+		{Name: "<b>bold</b>", Prefix: `"quoted"/`, Path: `/a"><script>x</script>/`},
+		{Name: "elsewhere", Path: "/other/", Host: "other.example.com"},
+	}
+	buckets[0].dir.size, buckets[0].dir.count = 10, 2
+
+	ctx := &fasthttp.RequestCtx{}
+	mountList(ctx, "files.example.com:8080", nil)
+	body := string(ctx.Response.Body())
+	for _, want := range []string{
+		`<a href="plain/">plain/</a>`,
+		`<a href="a&#34;&gt;&lt;script&gt;x&lt;/script&gt;/">`,
+		`&lt;b&gt;bold&lt;/b&gt;/&#34;quoted&#34;/`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("listing is missing %s:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "<script>x") || strings.Contains(body, "elsewhere") {
+		t.Errorf("listing is not escaped or shows another host:\n%s", body)
+	}
+
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.Header.Set("Accept", "list/json")
+	mountList(ctx, "files.example.com", func(p string, isDir bool) bool { return p == "/plain/" })
+	if body := string(ctx.Response.Body()); !strings.Contains(body, `"Name":"plain/","Size":10,"Count":2`) || strings.Contains(body, "bold") {
+		t.Errorf("unexpected JSON listing %s", body)
+	}
+}
+
+func TestMountListDuringListing(t *testing.T) {
+	saved := buckets
+	defer func() { buckets = saved }()
+	b := &Bucket{Name: "busy", Path: "/busy/"}
+	buckets = []*Bucket{b}
+
+	// Swap the index like buildDirList does, run with -race to see a race
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			b.dirLock.Lock()
+			b.dir = Root{size: int64(i), count: int64(i)}
+			b.dirLock.Unlock()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.Set("Accept", "list/json")
+		mountList(ctx, "", nil)
+	}
+	<-done
+}
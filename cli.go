@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Values of the settings given on the command line, these take precedence
+// over the environment and the config file.
+var flagValues = make(map[string]string)
+
+// A command line flag for a setting, the value is only recorded when the flag
+// is given so the other sources are used otherwise.
+type settingFlag struct {
+	s setting
+}
+
+func (f *settingFlag) String() string {
+	if v, ok := flagValues[f.s.Name]; ok {
+		return v
+	}
+	return f.s.Default
+}
+
+func (f *settingFlag) Set(v string) error {
+	flagValues[f.s.Name] = v
+	return nil
+}
+
+// Allow "--debug" on its own for the true / false settings
+func (f *settingFlag) IsBoolFlag() bool {
+	return f.s.Default == "true" || f.s.Default == "false"
+}
+
+// The flag name of a setting, for example BUCKET_NAME is --bucket-name
+func flagName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+}
+
+var commands = []struct{ Name, Usage string }{
+	{"serve", "Serve the bucket contents over HTTP (the default)"},
+	{"check-config", "Validate and print the merged configuration, exiting non-zero on any error"},
+}
+
+// Parse the command line into the subcommand and its arguments, setting
+// configFile and flagValues along the way.  The subcommand is the first
+// argument which is not a flag, so flags may come before or after it.  The
+// --help and --version flags print their output and exit without touching AWS.
+func parseArgs(args []string) (string, []string) {
+	fs := flag.NewFlagSet("bucket-http-proxy", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", os.Getenv("CONFIG_FILE"),
+		"Path to a YAML or TOML config file (env CONFIG_FILE)")
+	showVersion := fs.Bool("version", false, "Print the version and exit")
+	for _, s := range settings {
+		fs.Var(&settingFlag{s: s}, flagName(s.Name), s.Usage+" (env "+s.Name+")")
+	}
+	fs.Usage = func() {
+		w := fs.Output()
+		fmt.Fprintln(w, "Bucket-HTTP-Proxy", Version, "(github.com/pschou/bucket-http-proxy)")
+		fmt.Fprintln(w, "\nUsage: bucket-http-proxy [command] [flags]")
+		fmt.Fprintln(w, "\nCommands:")
+		for _, c := range commands {
+			fmt.Fprintf(w, "  %-14s %s\n", c.Name, c.Usage)
+		}
+		fmt.Fprintln(w, "\nFlags override the environment variables, which override the config file:")
+		fs.PrintDefaults()
+	}
+	var cmd string
+	var rest []string
+	for {
+		fs.Parse(args)
+		// Everything after a "--" is an argument, even when it looks like a flag
+		ended := len(fs.Args()) < len(args) && args[len(args)-len(fs.Args())-1] == "--"
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		if cmd == "" {
+			cmd = args[0]
+		} else {
+			rest = append(rest, args[0])
+		}
+		args = args[1:]
+		if ended {
+			rest = append(rest, args...)
+			break
+		}
+	}
+	if cmd == "" {
+		cmd = "serve"
+	}
+
+	if *showVersion {
+		fmt.Println(Version)
+		os.Exit(0)
+	}
+	for _, c := range commands {
+		if c.Name == cmd {
+			return cmd, rest
+		}
+	}
+	fmt.Fprintf(fs.Output(), "Unknown command %q\n\n", cmd)
+	fs.Usage()
+	os.Exit(2)
+	return "", nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args  []string
+		cmd   string
+		rest  []string
+		flags map[string]string
+	}{
+		{args: nil, cmd: "serve", flags: map[string]string{}},
+		{args: []string{"--debug"}, cmd: "serve", flags: map[string]string{"DEBUG": "true"}},
+		{args: []string{"check-config", "--debug"}, cmd: "check-config", flags: map[string]string{"DEBUG": "true"}},
+		{args: []string{"--debug", "check-config"}, cmd: "check-config", flags: map[string]string{"DEBUG": "true"}},
+		{args: []string{"--listen", ":8081", "serve", "--debug"}, cmd: "serve",
+			flags: map[string]string{"LISTEN": ":8081", "DEBUG": "true"}},
+		{args: []string{"--debug", "check-config", "proxy.yaml", "--bucket-name", "repo-test"}, cmd: "check-config",
+			rest: []string{"proxy.yaml"}, flags: map[string]string{"DEBUG": "true", "BUCKET_NAME": "repo-test"}},
+		{args: []string{"check-config", "--", "--odd.yaml"}, cmd: "check-config",
+			rest: []string{"--odd.yaml"}, flags: map[string]string{}},
+	}
+	for _, tt := range tests {
+		flagValues = make(map[string]string)
+		cmd, rest := parseArgs(tt.args)
+		if cmd != tt.cmd || !reflect.DeepEqual(rest, tt.rest) || !reflect.DeepEqual(flagValues, tt.flags) {
+			t.Errorf("%q: got %q %q %v, expected %q %q %v", tt.args, cmd, rest, flagValues, tt.cmd, tt.rest, tt.flags)
+		}
+	}
+	flagValues = make(map[string]string)
+}
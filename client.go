@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Endpoint settings for pointing the proxy at an S3 compatible store, such as
+// MinIO or Ceph RGW, instead of AWS.
+var (
+	s3Endpoint           string
+	s3PathStyle          bool
+	s3InsecureSkipVerify bool
+)
+
+// The region used for S3 compatible stores when none has been configured, as
+// the requests still need to be signed with a region.
+const defaultEndpointRegion = "us-east-1"
+
+// Construct a new S3 client from the AWS config with the endpoint settings applied.
+func newS3Client(cfg aws.Config) *s3.Client {
+	return s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if s3Endpoint != "" {
+			o.BaseEndpoint = aws.String(s3Endpoint)
+		}
+
+		// Path style puts the bucket name in the path (http://host/bucket/key)
+		// rather than in the host name (http://bucket.host/key).
+		o.UsePathStyle = s3PathStyle
+
+		if plainEndpoint() {
+			// Without TLS the payload would have to be read twice to be signed,
+			// which can't be done with a streamed upload.
+			o.APIOptions = append(o.APIOptions, v4.SwapComputePayloadSHA256ForUnsignedPayloadMiddleware)
+		}
+
+		if s3InsecureSkipVerify {
+			o.HTTPClient = awshttp.NewBuildableClient().WithTransportOptions(func(tr *http.Transport) {
+				tr.TLSClientConfig.InsecureSkipVerify = true
+			})
+		}
+	})
+}
+
+// Is the S3 endpoint plain HTTP?  Checksums of streamed uploads are sent as a
+// trailer after the body, which S3 only supports over TLS, so the checksums
+// have to be provided up front by the client instead.
+func plainEndpoint() bool {
+	return strings.HasPrefix(strings.ToLower(s3Endpoint), "http:")
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// A setting which can be provided in the config file or by an environment
+// variable of the same name.
+type setting struct {
+	Name    string
+	Default string
+	Usage   string
+	Check   func(string) error
+}
+
+// All the settings known to the proxy, in the order they are printed.
+var settings = []setting{
+	{"BUCKET_NAME", "my-bucket", "The name of the bucket to be served", checkNotEmpty},
+	{"BUCKET_REGION", "", "The region of the bucket, when empty AWS_REGION, the AWS profile, or IMDS is used", nil},
+	{"BUCKET_PREFIX", "", "Only serve the keys under this prefix of the bucket, for example: \"some/team/prefix/\"", checkPrefix},
+	{"BUCKET_ROLE_ARN", "", "Assume this IAM role to access the bucket, for example: \"arn:aws:iam::123456789012:role/reader\"", nil},
+	{"BUCKET_ROLE_EXTERNAL_ID", "", "The external ID to use when assuming the bucket role", nil},
+	{"BUCKET_ROLE_SESSION_NAME", "", "The session name to use when assuming the bucket role", nil},
+	{"S3_ENDPOINT", "", "Custom S3 endpoint URL for S3 compatible stores, for example: \"https://minio.local:9000\"", checkURL},
+	{"S3_PATH_STYLE", "false", "Use path style addressing (http://host/bucket/key) instead of virtual hosted style", checkBool},
+	{"S3_INSECURE_SKIP_VERIFY", "false", "Skip the TLS certificate verification of the S3 endpoint", checkBool},
+	{"LISTEN", ":8080", "The listening port to serve the contents of the bucket from", checkAddr},
+	{"TLS_CERT_FILE", "", "Serve HTTPS with this certificate file, re-read when it changes, for example: \"/etc/pki/tls/certs/proxy.pem\"", checkFile},
+	{"TLS_KEY_FILE", "", "The private key file for TLS_CERT_FILE", checkFile},
+	{"TLS_CLIENT_CA_FILE", "", "Verify client certificates against this CA bundle", checkFile},
+	{"TLS_CLIENT_CERT_REQUIRED", "false", "Refuse connections without a valid client certificate", checkBool},
+	{"TLS_CLIENT_USER", "cn", "Where the user name of a client certificate is taken from: cn, email, dns or uri", checkCertField},
+	{"TRUSTED_PROXIES", "", "Take the client address from X-Forwarded-For when connected from these addresses or CIDRs, for example: \"10.0.0.5 10.1.0.0/16\"", checkPrefixes},
+	{"PROXY_PROTOCOL", "false", "Read the PROXY protocol header from the connections of the TRUSTED_PROXIES", checkBool},
+	{"ADMIN_LISTEN", "", "Listen address for the admin endpoints (/healthz, /reload, /quota), for example: \"127.0.0.1:8081\"", checkAddr},
+	{"SHUTDOWN_GRACE", "30s", "How long to let active transfers finish on SIGTERM or SIGINT before aborting them", checkDuration},
+	{"REFRESH", "20m", "The refresh interval for grabbing new AMI credentials", checkDuration},
+	{"REFRESH_FAILURES", "3", "How many credential refreshes may fail in a row before the proxy is reported as not ready", checkPositive},
+	{"DIRECTORY_INDEX", "", "Which file to use for a directory index, for example: \"index.html index.htm\"", nil},
+	{"DIRECTORY_HEADER", "", "If an html file is specified it will be prepended to the directory listing, for example: \"header.html\"", nil},
+	{"DIRECTORY_FOOTER", "", "Like header but appended to the directory listing, for example: \"footer.html\" or \"/.footer.html\" for an absolute path", nil},
+	{"AUDIT_LOG", "", "Write a JSON line for every upload, delete, copy, move and link to this file, or \"-\" for stdout", nil},
+	{"AUDIT_MAX_SIZE", "100M", "Rotate the audit log when it reaches this size, 0 to only rotate by age", checkSize},
+	{"AUDIT_MAX_AGE", "24h", "Rotate the audit log when it is this old, 0 to only rotate by size", checkAge},
+	{"AUDIT_MIRROR_PATH", "", "Upload rotated audit logs to this path of a served bucket, for example: \"/_audit/\"", checkMountPath},
+	{"MULTIPART_THRESHOLD", "100M", "Uploads larger than this are sent to S3 in parts", checkSize},
+	{"MULTIPART_PART_SIZE", "64M", "The size of the parts of a multipart upload, between 5M and 5G", checkPartSize},
+	{"MULTIPART_CONCURRENCY", "4", "How many parts are sent at once, across all uploads, each takes a part size of memory", checkPositive},
+	{"EXTRACT_MAX_SIZE", "1G", "The largest zip archive which may be unpacked, it is spooled to TMPDIR first", checkSize},
+	{"TUS_STATE_DIR", "", "Accept resumable tus uploads, keeping their state and unsent data in this directory, for example: \"/var/lib/bucket-http-proxy/tus\"", nil},
+	{"TUS_MAX_AGE", "24h", "Throw away tus uploads which have not been added to for this long", checkDuration},
+	{"MODIFY_ALLOW_HEADER", "", "Look for this header in the request to allow bucket write permissions", nil},
+	{"FORWARDED_USER_HEADER", "", "Take the user from this header when the request comes from one of the TRUSTED_PROXIES, for example: \"X-Forwarded-User\"", nil},
+	{"FORWARDED_GROUPS_HEADER", "", "Take the groups, separated by commas or spaces, from this header of a trusted proxy, for example: \"X-Forwarded-Groups\"", nil},
+	{"HTPASSWD_FILE", "", "Allow the users in this htpasswd file to modify the bucket using HTTP Basic auth, for example: \"/etc/bucket-http-proxy.htpasswd\"", checkFile},
+	{"JWT_JWKS", "", "Accept bearer tokens signed by the keys in this JWKS file or URL, for example: \"https://issuer.example.com/.well-known/jwks.json\"", checkJWKS},
+	{"JWT_ISSUER", "", "The required issuer (iss) of bearer tokens", nil},
+	{"JWT_AUDIENCE", "", "The required audience (aud) of bearer tokens", nil},
+	{"JWT_USER_CLAIM", "sub", "The token claim with the user name, nested claims use dots like \"realm_access.user\"", checkNotEmpty},
+	{"JWT_GROUPS_CLAIM", "groups", "The token claim with the groups of the user", checkNotEmpty},
+	{"ACL_FILE", "", "Only allow the requests granted by the rules in this YAML file, for example: \"/etc/bucket-http-proxy.acl.yaml\"", checkFile},
+	{"QUOTA_FILE", "", "Limit the bytes and objects stored under paths by the quotas in this YAML file, for example: \"/etc/bucket-http-proxy.quota.yaml\"", checkFile},
+	{"SHARE_SECRET", "", "Secret (at least 32 characters) for signing share links, share links are disabled when empty", checkSecret},
+	{"SHARE_MAX_AGE", "168h", "The longest a share link may be valid for", checkDuration},
+	{"SHARE_REVOKED_FILE", "", "File with the IDs of revoked share links, one per line, for example: \"/etc/bucket-http-proxy.revoked\"", nil},
+	{"RATE_LIST", "", "Limit directory listings per client IP or user, for example: \"10/s\" or \"600/m:100\" with a burst of 100", checkRate},
+	{"RATE_DOWNLOAD", "", "Limit file downloads per client IP or user, like RATE_LIST", checkRate},
+	{"RATE_DOWNLOAD_BYTES", "", "Limit the bytes downloaded per client IP or user, for example: \"50M/s\"", checkRate},
+	{"RATE_WRITE", "", "Limit uploads, deletes and other changes per client IP or user, like RATE_LIST", checkRate},
+	{"RATE_WRITE_BYTES", "", "Limit the bytes uploaded per client IP or user, for example: \"20M/s:1G\"", checkRate},
+	{"RATE_AUTH_FAILURES", "10/m:20", "Limit the failed logins per client IP, further logins are refused until it recovers", checkRate},
+	{"AUTH_REALM", "Bucket-HTTP-Proxy", "The realm presented in the HTTP Basic auth challenge", checkNotEmpty},
+	{"SSL_CERT_FILE", "", "Override the system CA chain default with this CA file", checkFile},
+	{"DEBUG", "false", "Turn on debugging output for evaluating what is happening", checkBool},
+}
+
+// Sources of a setting value
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+)
+
+// The merged configuration from the defaults, the config file, the
+// environment and the command line flags, in that order of precedence.
+type Config struct {
+	File    string
+	Buckets []*Bucket
+	ACL     *acl
+	Quotas  *quotas
+	values  map[string]string
+	sources map[string]string
+}
+
+// Load the config file (if any), overlay the environment and the flags and
+// validate the result.  A config is always returned so the merged values can be shown
+// alongside any errors.
+func loadConfig(file string) (*Config, []error) {
+	c := &Config{
+		File:    file,
+		values:  make(map[string]string),
+		sources: make(map[string]string),
+	}
+	for _, s := range settings {
+		c.values[s.Name] = s.Default
+		c.sources[s.Name] = sourceDefault
+	}
+
+	var errs []error
+	if file != "" {
+		raw, err := readConfigFile(file)
+		if err != nil {
+			return c, []error{err}
+		}
+		keys := make([]string, 0, len(raw))
+		for key := range raw {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			val := raw[key]
+			name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+			if name == "BUCKETS" {
+				if c.Buckets, err = parseBuckets(val); err != nil {
+					errs = append(errs, fmt.Errorf("%s: buckets: %w", file, err))
+				}
+				continue
+			}
+			if _, ok := c.values[name]; !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown setting %q", file, key))
+				continue
+			}
+			str, err := configString(val)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s: %w", file, key, err))
+				continue
+			}
+			c.values[name] = str
+			c.sources[name] = sourceFile
+		}
+	}
+
+	for _, s := range settings {
+		if e := os.Getenv(s.Name); len(e) > 0 {
+			c.values[s.Name] = e
+			c.sources[s.Name] = sourceEnv
+		}
+		if f, ok := flagValues[s.Name]; ok {
+			c.values[s.Name] = f
+			c.sources[s.Name] = sourceFlag
+		}
+	}
+
+	for _, s := range settings {
+		// Empty values are only checked when the setting expects a value
+		if s.Check == nil || (c.values[s.Name] == "" && s.Default == "") {
+			continue
+		}
+		if err := s.Check(c.values[s.Name]); err != nil {
+			errs = append(errs, fmt.Errorf("%s=%q (%s): %w", s.Name, c.values[s.Name], c.sources[s.Name], err))
+		}
+	}
+
+	if (c.Get("TLS_CERT_FILE") == "") != (c.Get("TLS_KEY_FILE") == "") {
+		errs = append(errs, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be given together"))
+	}
+	if c.Get("TLS_CLIENT_CA_FILE") != "" && c.Get("TLS_CERT_FILE") == "" {
+		errs = append(errs, fmt.Errorf("TLS_CLIENT_CA_FILE needs TLS_CERT_FILE and TLS_KEY_FILE"))
+	}
+	if c.Get("JWT_JWKS") != "" && c.Get("JWT_ISSUER") == "" && c.Get("JWT_AUDIENCE") == "" {
+		// Keys like those of a shared identity provider sign tokens for everyone
+		errs = append(errs, fmt.Errorf("JWT_JWKS needs JWT_ISSUER, JWT_AUDIENCE or both"))
+	}
+	if c.Get("MODIFY_ALLOW_HEADER") != "" && (c.Get("HTPASSWD_FILE") != "" || c.Get("JWT_JWKS") != "") &&
+		c.Get("TRUSTED_PROXIES") == "" {
+		// Otherwise any client could name itself a user of the logins
+		errs = append(errs, fmt.Errorf("MODIFY_ALLOW_HEADER with HTPASSWD_FILE or JWT_JWKS needs TRUSTED_PROXIES"))
+	}
+	if c.Bool("PROXY_PROTOCOL") && c.Get("TRUSTED_PROXIES") == "" {
+		errs = append(errs, fmt.Errorf("PROXY_PROTOCOL needs TRUSTED_PROXIES"))
+	}
+	if c.Get("FORWARDED_USER_HEADER") != "" && c.Get("TRUSTED_PROXIES") == "" {
+		errs = append(errs, fmt.Errorf("FORWARDED_USER_HEADER needs TRUSTED_PROXIES"))
+	}
+	if c.Get("FORWARDED_GROUPS_HEADER") != "" && c.Get("FORWARDED_USER_HEADER") == "" {
+		errs = append(errs, fmt.Errorf("FORWARDED_GROUPS_HEADER needs FORWARDED_USER_HEADER"))
+	}
+
+	// Without a buckets section the single bucket is served from the root
+	if len(c.Buckets) == 0 {
+		c.Buckets = []*Bucket{{
+			Name:        c.Get("BUCKET_NAME"),
+			Prefix:      c.Get("BUCKET_PREFIX"),
+			Region:      c.Get("BUCKET_REGION"),
+			RoleARN:     c.Get("BUCKET_ROLE_ARN"),
+			ExternalID:  c.Get("BUCKET_ROLE_EXTERNAL_ID"),
+			SessionName: c.Get("BUCKET_ROLE_SESSION_NAME"),
+		}}
+	}
+	errs = append(errs, checkBuckets(c.Buckets)...)
+
+	if file := c.Get("ACL_FILE"); file != "" {
+		var err error
+		if c.ACL, err = loadACL(file); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if file := c.Get("QUOTA_FILE"); file != "" {
+		var err error
+		if c.Quotas, err = loadQuotas(file); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return c, errs
+}
+
+// Parse the config file as TOML or YAML, based on the file extension.  JSON
+// files are read as YAML.
+func readConfigFile(file string) (map[string]interface{}, error) {
+	dat, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".toml":
+		err = toml.Unmarshal(dat, &raw)
+	default:
+		err = yaml.Unmarshal(dat, &raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return raw, nil
+}
+
+// Flatten a value from the config file into the string form used by the
+// environment variables.  Lists are joined with spaces.
+func configString(val interface{}) (string, error) {
+	switch t := val.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return t, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(t), nil
+	case []interface{}:
+		var parts []string
+		for _, v := range t {
+			s, err := configString(v)
+			if err != nil {
+				return "", err
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, " "), nil
+	}
+	return "", fmt.Errorf("unexpected %T value", val)
+}
+
+func (c *Config) Get(name string) string {
+	return c.values[name]
+}
+
+func (c *Config) Source(name string) string {
+	return c.sources[name]
+}
+
+func (c *Config) Bool(name string) bool {
+	b, _ := strconv.ParseBool(c.values[name])
+	return b
+}
+
+func (c *Config) Int(name string) int {
+	i, _ := strconv.Atoi(c.values[name])
+	return i
+}
+
+func (c *Config) Duration(name string) time.Duration {
+	d, _ := time.ParseDuration(c.values[name])
+	return d
+}
+
+func (c *Config) Fields(name string) []string {
+	return strings.Fields(c.values[name])
+}
+
+// Print out the merged configuration with the source of each value.
+func (c *Config) Print(w io.Writer) {
+	if c.File != "" {
+		fmt.Fprintf(w, "  # config file %s\n", c.File)
+	}
+	for _, s := range settings {
+		val := c.values[s.Name]
+		if strings.HasSuffix(s.Name, "_SECRET") && val != "" {
+			val = "********"
+		}
+		fmt.Fprintf(w, "  %s=%q (%s)\n", s.Name, val, c.sources[s.Name])
+	}
+	fmt.Fprint(w, c.routes())
+	if c.ACL != nil {
+		fmt.Fprintf(w, "  %d access rules and %d network rules loaded from %s\n", len(c.ACL.Rules), len(c.ACL.Networks), c.ACL.File)
+	}
+	if c.Quotas != nil {
+		fmt.Fprintf(w, "  %d quotas loaded from %s\n", len(c.Quotas.Quotas), c.Quotas.File)
+	}
+}
+
+// Describe the bucket routes, one per line.
+func (c *Config) routes() string {
+	var sb strings.Builder
+	for _, b := range c.Buckets {
+		fmt.Fprintf(&sb, "  bucket %s%s -> %s/%s", b.Host, b.Path, b.Name, b.Prefix)
+		if b.Region != "" {
+			fmt.Fprintf(&sb, " (%s)", b.Region)
+		}
+		if b.RoleARN != "" {
+			fmt.Fprintf(&sb, " as %s", b.RoleARN)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// Validate and print out the configuration, returning the exit code.
+func checkConfig(args []string) int {
+	if len(args) > 0 {
+		configFile = args[0]
+	}
+	conf, errs := loadConfig(configFile)
+	fmt.Println("Configuration:")
+	conf.Print(os.Stdout)
+	if len(errs) > 0 {
+		fmt.Println("Errors:")
+		for _, err := range errs {
+			fmt.Println(" ", err)
+		}
+		return 1
+	}
+	fmt.Println("Configuration OK")
+	return 0
+}
+
+func checkNotEmpty(v string) error {
+	if strings.TrimSpace(v) == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	return nil
+}
+
+func checkBool(v string) error {
+	_, err := strconv.ParseBool(v)
+	return err
+}
+
+func checkPositive(v string) error {
+	i, err := strconv.Atoi(v)
+	if err == nil && i <= 0 {
+		err = fmt.Errorf("must be greater than zero")
+	}
+	return err
+}
+
+func checkPrefix(v string) error {
+	if strings.HasPrefix(v, "/") || !validPath(v) {
+		return fmt.Errorf("must be a relative key prefix without \"..\"")
+	}
+	return nil
+}
+
+func checkMountPath(v string) error {
+	if !strings.HasPrefix(v, "/") || !strings.HasSuffix(v, "/") || !validPath(v) {
+		return fmt.Errorf("must be a path starting and ending with /")
+	}
+	return nil
+}
+
+func checkSecret(v string) error {
+	if len(v) < 32 {
+		return fmt.Errorf("must be at least 32 characters")
+	}
+	return nil
+}
+
+func checkDuration(v string) error {
+	d, err := time.ParseDuration(v)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("must be greater than zero")
+	}
+	return err
+}
+
+// A duration which may also be 0 to turn something off
+func checkAge(v string) error {
+	d, err := time.ParseDuration(v)
+	if err == nil && d < 0 {
+		err = fmt.Errorf("must not be negative")
+	}
+	return err
+}
+
+func checkURL(v string) error {
+	if u, err := url.Parse(v); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("expected a URL like https://host:port")
+	}
+	return nil
+}
+
+func checkJWKS(v string) error {
+	if strings.HasPrefix(v, "https://") || strings.HasPrefix(v, "http://") {
+		return checkURL(v)
+	}
+	return checkFile(v)
+}
+
+func checkAddr(v string) error {
+	_, port, err := net.SplitHostPort(v)
+	if err == nil {
+		_, err = strconv.ParseUint(port, 10, 16)
+	}
+	return err
+}
+
+func checkFile(v string) error {
+	_, err := os.Stat(v)
+	return err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/ec2rolecreds"
+	"github.com/aws/aws-sdk-go-v2/credentials/endpointcreds"
+	"github.com/aws/aws-sdk-go-v2/credentials/processcreds"
+	"github.com/aws/aws-sdk-go-v2/credentials/ssocreds"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+)
+
+// How long to wait on the instance metadata service before deciding that we
+// are not running on EC2.
+var imdsTimeout = 2 * time.Second
+
+// Load the AWS configuration using the standard credential provider chain,
+// which is tried in this order:
+//
+//   - static keys from AWS_ACCESS_KEY_ID / AWS_SECRET_ACCESS_KEY
+//   - the shared config profile (AWS_PROFILE, ~/.aws/config and ~/.aws/credentials)
+//   - a web identity token (AWS_WEB_IDENTITY_TOKEN_FILE + AWS_ROLE_ARN, as used by EKS IRSA)
+//   - ECS container credentials (AWS_CONTAINER_CREDENTIALS_*)
+//   - the role attached to the EC2 instance via IMDS
+//
+// The region is taken from the region argument if set, then from the AWS
+// config (AWS_REGION or the profile), and finally from IMDS.
+func loadAWSConfig(ctx context.Context, region string) (cfg aws.Config, err error) {
+	var opts []func(*config.LoadOptions) error
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	cfg, err = config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return
+	}
+
+	if cfg.Region == "" && s3Endpoint != "" {
+		// S3 compatible stores are not on EC2, so don't wait on IMDS
+		cfg.Region = defaultEndpointRegion
+	}
+	if cfg.Region == "" {
+		imdsCtx, cancel := context.WithTimeout(ctx, imdsTimeout)
+		defer cancel()
+		if gro, err := imds.NewFromConfig(cfg).GetRegion(imdsCtx, &imds.GetRegionInput{}); err == nil {
+			cfg.Region = gro.Region
+		}
+	}
+	if cfg.Region == "" {
+		err = errors.New("could not determine the AWS region, set BUCKET_REGION or AWS_REGION")
+	}
+	return
+}
+
+// Map the credential source reported by the SDK to the name of the provider
+// in the chain.
+func credentialProvider(source string) string {
+	switch {
+	case strings.HasPrefix(source, "EnvConfigCredentials"):
+		return "environment"
+	case strings.HasPrefix(source, "SharedConfigCredentials"):
+		return "shared config profile"
+	case strings.HasPrefix(source, stscreds.WebIdentityProviderName):
+		return "web identity"
+	case strings.HasPrefix(source, stscreds.ProviderName):
+		return "assume role"
+	case strings.HasPrefix(source, endpointcreds.ProviderName):
+		return "ECS container"
+	case strings.HasPrefix(source, ec2rolecreds.ProviderName):
+		return "EC2 instance profile"
+	case strings.HasPrefix(source, ssocreds.ProviderName):
+		return "SSO"
+	case strings.HasPrefix(source, processcreds.ProviderName):
+		return "credential process"
+	}
+	return source
+}
+
+// Retrieve credentials from the chain and print out which provider was used.
+func describeCredentials(ctx context.Context, cfg aws.Config) error {
+	creds, err := cfg.Credentials.Retrieve(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Println("  AWS_REGION:", cfg.Region)
+	fmt.Printf("  CREDENTIALS: %s (%s)\n", credentialProvider(creds.Source), creds.Source)
+	if creds.CanExpire {
+		fmt.Println("  EXPIRES:", creds.Expires.UTC().Format(time.RFC1123))
+	}
+
+	if strings.HasPrefix(creds.Source, ec2rolecreds.ProviderName) {
+		imdsCtx, cancel := context.WithTimeout(ctx, imdsTimeout)
+		defer cancel()
+		if iam, err := imds.NewFromConfig(cfg).GetIAMInfo(imdsCtx, &imds.GetIAMInfoInput{}); err == nil {
+			fmt.Println("  IMDS_ARN:", iam.IAMInfo.InstanceProfileArn)
+			fmt.Println("  IMDS_ID:", iam.IAMInfo.InstanceProfileID)
+		}
+	}
+	return nil
+}
@@ -1,16 +1,17 @@
 package main
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
+	"html"
 	"io"
 	"log"
+	"net/url"
 	"sort"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/pschou/go-convert/bin"
@@ -22,17 +23,17 @@ import (
 type DirItem struct {
 	Name         string
 	Time         *time.Time `json:",omitempty"`
-	realTime     *time.Time `json:",omitempty"`
+	realTime     *time.Time
 	Size         int64
-	Count        int64                    `json:",omitempty"`
-	eTag         string                   `json:",omitempty"`
+	Count        int64 `json:",omitempty"`
+	eTag         string
 	StorageClass types.ObjectStorageClass `json:",omitempty"`
 	Checksum     string                   `json:",omitempty"`
 	isDir        bool
 	list         []*DirItem
 }
 
-func (d *DirItem) getHead(base string) {
+func (d *DirItem) getHead(b *Bucket, base string) {
 	if len(d.Checksum) > 0 || len(d.Name) == 0 || d.Name[len(d.Name)-1] == '/' {
 		return
 	}
@@ -43,9 +44,9 @@ func (d *DirItem) getHead(base string) {
 	if debug {
 		log.Println("cache check", fmt.Sprintf("%q%q", name, eTag))
 	}
-	hashCacheMutex.Lock()
-	h, ok := hashCache[fmt.Sprintf("%q%q", name, eTag)]
-	hashCacheMutex.Unlock()
+	b.hashCacheMutex.Lock()
+	h, ok := b.hashCache[fmt.Sprintf("%q%q", name, eTag)]
+	b.hashCacheMutex.Unlock()
 
 	if ok && h.realTime.Equal(*cmpTime) {
 		if debug {
@@ -62,15 +63,15 @@ func (d *DirItem) getHead(base string) {
 	if debug {
 		log.Println("calling gethash", name, eTag, *cmpTime)
 	}
-	obj, err := s3Client.HeadObject(context.TODO(), &s3.HeadObjectInput{
-		Bucket:       &bucketName,
-		Key:          &name,
+	obj, err := b.S3().HeadObject(abortCtx, &s3.HeadObjectInput{
+		Bucket:       &b.Name,
+		Key:          aws.String(b.key(name)),
 		ChecksumMode: types.ChecksumModeEnabled,
 	})
 	if err == nil {
 		var outHash string
 		if d.Size > 0 {
-			outHash = encodeChecksum(obj)
+			outHash = b.objectChecksum(b.key(name), obj)
 		}
 		if debug {
 			log.Println("cache save", fmt.Sprintf("%q%q", name, unquote(*obj.ETag)), outHash)
@@ -91,9 +92,9 @@ func (d *DirItem) getHead(base string) {
 			outHash = "-> " + link
 		}
 
-		hashCacheMutex.Lock()
-		hashCache[fmt.Sprintf("%q%q", name, unquote(*obj.ETag))] = hashdat{time: *outTime, hash: outHash, realTime: *obj.LastModified}
-		hashCacheMutex.Unlock()
+		b.hashCacheMutex.Lock()
+		b.hashCache[fmt.Sprintf("%q%q", name, unquote(*obj.ETag))] = hashdat{time: *outTime, hash: outHash, realTime: *obj.LastModified}
+		b.hashCacheMutex.Unlock()
 		d.Time = outTime
 		d.Checksum = outHash
 	}
@@ -101,14 +102,7 @@ func (d *DirItem) getHead(base string) {
 }
 
 var (
-	bucketDir       Root
-	bucketDirLock   sync.Mutex
-	bucketDirError  error
-	bucketDirUpdate time.Time
-	bucketTimeout   = 15 * time.Second
-
-	hashCache      = make(map[string]hashdat)
-	hashCacheMutex sync.Mutex
+	bucketTimeout = 15 * time.Second
 )
 
 type hashdat struct {
@@ -124,26 +118,27 @@ type Root struct {
 }
 
 // Use the objects map to determine if an item is a directory (either explicit or implicit)
-func isDir(test string) bool {
-	obj, exists := bucketDir.objects[test]
+func (b *Bucket) isDir(test string) bool {
+	obj, exists := b.dir.objects[test]
 	return exists && obj.isDir
 }
 
 // Use the objects map to determine if an item is a file
-func isFile(test string) bool {
-	obj, exists := bucketDir.objects[test]
+func (b *Bucket) isFile(test string) bool {
+	obj, exists := b.dir.objects[test]
 	return exists && !obj.isDir
 }
 
 // Walk the object map providing the list of objects in a JSON formatted reply.
-func jsonList(baseDir string, ctx *fasthttp.RequestCtx, recursive bool) {
+// When visible is set, only the entries it allows are listed.
+func jsonList(b *Bucket, baseDir string, ctx *fasthttp.RequestCtx, recursive bool, visible func(p string, isDir bool) bool) {
 	ctx.Write([]byte("{\"/\":\n["))
 	defer ctx.Write([]byte("]}"))
 
 	encoder := json.NewEncoder(ctx)
 	dirs := []string{baseDir}
 	wg := sizedwaitgroup.New(8)
-	objects := bucketDir.objects
+	objects := b.dir.objects
 
 	for i := 0; i < len(dirs); i++ {
 		if i > 0 {
@@ -161,7 +156,7 @@ func jsonList(baseDir string, ctx *fasthttp.RequestCtx, recursive bool) {
 					wg.Add()
 					go func(j int) {
 						defer wg.Done()
-						curDir.list[j].getHead(dirs[i])
+						curDir.list[j].getHead(b, dirs[i])
 					}(j)
 				}
 			}
@@ -170,6 +165,9 @@ func jsonList(baseDir string, ctx *fasthttp.RequestCtx, recursive bool) {
 
 		var pastFirst bool
 		for _, c := range curDir.list {
+			if visible != nil && !visible(b.Path+dirs[i]+c.Name, c.isDir) {
+				continue
+			}
 			if recursive && len(c.Name) > 0 && c.Name[len(c.Name)-1] == '/' {
 				dirs = append(dirs, dirs[i]+c.Name)
 			}
@@ -188,8 +186,8 @@ func jsonList(baseDir string, ctx *fasthttp.RequestCtx, recursive bool) {
 
 }
 
-func dirList(dir string, ctx *fasthttp.RequestCtx, header, footer string) {
-	curDir, ok := bucketDir.objects[dir]
+func dirList(b *Bucket, dir string, ctx *fasthttp.RequestCtx, header, footer string, visible func(p string, isDir bool) bool, upload bool) {
+	curDir, ok := b.dir.objects[dir]
 	if !ok {
 		ctx.Error("404 path not found: "+dir, fasthttp.StatusNotFound)
 		return
@@ -202,7 +200,7 @@ func dirList(dir string, ctx *fasthttp.RequestCtx, header, footer string) {
 			`<!DOCTYPE HTML PUBLIC "-//W3C//DTD HTML 3.2 Final//EN">
 <html>
  <head>
-  <title>Index of /%s</title>
+  <title>Index of %s%s</title>
 	<style>
 body { font-family:arial,sans-serif;line-height:normal; }
 #entries { font-family: monospace, monospace; }
@@ -210,13 +208,13 @@ body { font-family:arial,sans-serif;line-height:normal; }
   </style>
  </head>
  <body>
-`, dir)
+`, html.EscapeString(b.Path), html.EscapeString(dir))
 	}
 
 	if header != "" {
-		obj, err := s3Client.GetObject(context.TODO(), &s3.GetObjectInput{
-			Bucket: &bucketName,
-			Key:    &header,
+		obj, err := b.S3().GetObject(abortCtx, &s3.GetObjectInput{
+			Bucket: &b.Name,
+			Key:    aws.String(b.key(header)),
 		})
 		if err == nil {
 			io.Copy(ctx, obj.Body)
@@ -226,16 +224,17 @@ body { font-family:arial,sans-serif;line-height:normal; }
 		}
 	} else {
 		fmt.Fprintf(ctx,
-			` <h1>Index of /%s</h1>
-`, dir)
+			` <h1>Index of %s%s</h1>
+`, html.EscapeString(b.Path), html.EscapeString(dir))
 	}
 
 	fmt.Fprintf(ctx, ` <table id="entries">
   <tr><th onclick="sortTable(0)">Name</th><th onclick="sortTable(1)">Last modified</th><th onclick="sortTable(2)">Size</th><th onclick="sortTable(3)">Checksum</th></tr>
   <tr><th colspan="4"><hr></th></tr>
 `)
+	shareQuery, _ := ctx.UserValue("shareQuery").(string)
 	tableHeaders := "2"
-	if len(dir) > 0 {
+	if len(dir) > 0 || b.Path != "/" {
 		tableHeaders = "3"
 		fmt.Fprintf(ctx, `  <tr><td><a href="..">../</a></td><td align="right"></td><td align="right">-</td><td></td><td></td></tr>
 `)
@@ -251,7 +250,7 @@ body { font-family:arial,sans-serif;line-height:normal; }
 				wg.Add()
 				go func(i int) {
 					defer wg.Done()
-					curDir.list[i].getHead(dir)
+					curDir.list[i].getHead(b, dir)
 				}(i)
 			}
 		}
@@ -263,6 +262,9 @@ body { font-family:arial,sans-serif;line-height:normal; }
 		if len(name) > 0 && name[0] == '.' {
 			continue
 		}
+		if visible != nil && !visible(b.Path+dir+name, c.isDir) {
+			continue
+		}
 
 		var timeStr string
 		fSize := c.Size
@@ -274,9 +276,24 @@ body { font-family:arial,sans-serif;line-height:normal; }
 		}
 		binSize := bin.NewBytes(fSize)
 
+		// Names come from whoever uploaded the file, a folder keeps its slash
+		href := url.PathEscape(strings.TrimSuffix(name, "/"))
+		if strings.HasSuffix(name, "/") {
+			href += "/"
+		}
 		fmt.Fprintf(ctx,
-			`  <tr><td num="%d"><a href=%q>%s</a></td><td align="right">%s</td><td align="right" num="%d">&nbsp; %0.4v</td><td>&nbsp; %s</td></tr>
-`, i, name, name, timeStr, fSize, binSize, fChecksum)
+			`  <tr><td num="%d"><a href="%s">%s</a></td><td align="right">%s</td><td align="right" num="%d">&nbsp; %0.4v</td><td>&nbsp; %s</td></tr>
+`, i, html.EscapeString(href+shareQuery), html.EscapeString(name), timeStr, fSize, binSize, html.EscapeString(fChecksum))
+	}
+
+	if id := identity(ctx); id != nil {
+		// Show who the proxy thinks is looking, groups decide what is listed
+		signedIn := "Signed in as " + html.EscapeString(id.String())
+		if len(id.Groups) > 0 {
+			signedIn += " in " + html.EscapeString(strings.Join(id.Groups, ", "))
+		}
+		fmt.Fprintf(ctx, `  <tr><td colspan="4" align="right" style='font-size: x-small;'><hr>%s</td></tr>
+`, signedIn)
 	}
 
 	fmt.Fprintf(ctx,
@@ -357,10 +374,15 @@ function sortTable(n) {
  </script>
 `, tableHeaders)
 
+	if upload {
+		// Files dropped on the form, or picked with it, are posted to this folder
+		ctx.WriteString(uploadForm)
+	}
+
 	if footer != "" {
-		obj, err := s3Client.GetObject(context.TODO(), &s3.GetObjectInput{
-			Bucket: &bucketName,
-			Key:    &footer,
+		obj, err := b.S3().GetObject(abortCtx, &s3.GetObjectInput{
+			Bucket: &b.Name,
+			Key:    aws.String(b.key(footer)),
 		})
 		if err == nil {
 			io.Copy(ctx, obj.Body)
@@ -377,17 +399,22 @@ function sortTable(n) {
 
 }
 
-func buildDirList() {
-	bucketDirLock.Lock()
-	defer bucketDirLock.Unlock()
+func (b *Bucket) buildDirList() {
+	b.dirLock.Lock()
+	defer b.dirLock.Unlock()
 	// Short circuit again after lock
-	if time.Now().Sub(bucketDirUpdate) < bucketTimeout {
+	if time.Now().Sub(b.dirUpdate) < bucketTimeout {
 		return
 	}
 	var listErr error
 
-	if bucketDirUpdate.IsZero() || time.Now().Sub(bucketDirUpdate) > bucketTimeout {
-		lop := s3.NewListObjectsV2Paginator(s3Client, &s3.ListObjectsV2Input{Bucket: &bucketName})
+	if b.dirUpdate.IsZero() || time.Now().Sub(b.dirUpdate) > bucketTimeout {
+		listed := time.Now()
+		listInput := &s3.ListObjectsV2Input{Bucket: &b.Name}
+		if b.Prefix != "" {
+			listInput.Prefix = &b.Prefix
+		}
+		lop := s3.NewListObjectsV2Paginator(b.S3(), listInput)
 		newDir := Root{objects: make(map[string]*DirItem)}
 		RootItem := &DirItem{Name: "", isDir: true}
 		newDir.objects[""] = RootItem
@@ -396,7 +423,7 @@ func buildDirList() {
 		var ok bool
 
 		for lop.HasMorePages() {
-			page, err := lop.NextPage(context.TODO())
+			page, err := lop.NextPage(abortCtx)
 			if err != nil {
 				if debug {
 					log.Println("Error listing bucket:", err)
@@ -407,7 +434,12 @@ func buildDirList() {
 			var count int64
 		contents_loop:
 			for _, c := range page.Contents {
-				parts := strings.Split(*c.Key, "/")
+				// Keys are indexed relative to the key prefix
+				key := strings.TrimPrefix(*c.Key, b.Prefix)
+				if len(key) == 0 {
+					continue
+				}
+				parts := strings.Split(key, "/")
 				newDir.size += c.Size
 				newDir.count++
 
@@ -428,8 +460,8 @@ func buildDirList() {
 						newDir.objects[curPath] = next
 						pathObject.list = append(pathObject.list, next)
 					} else {
-						pathObject.Size += c.Size
-						pathObject.Count += count
+						next.Size += c.Size
+						next.Count += count
 					}
 					pathObject = next
 
@@ -444,7 +476,7 @@ func buildDirList() {
 
 				next = &DirItem{Name: parts[0], Size: c.Size, Time: c.LastModified, realTime: c.LastModified,
 					eTag: unquote(*c.ETag), StorageClass: c.StorageClass}
-				newDir.objects[*c.Key] = next
+				newDir.objects[key] = next
 				pathObject.list = append(pathObject.list, next)
 			}
 		}
@@ -454,8 +486,9 @@ func buildDirList() {
 				sort.Slice(obj.list, func(i, j int) bool { return numstr.LessThanFold(obj.list[i].Name, obj.list[j].Name) })
 			}
 		}
-		bucketDirError = listErr
-		bucketDir = newDir
-		bucketDirUpdate = time.Now()
+		b.dirError = listErr
+		b.dir = newDir
+		b.dirUpdate = time.Now()
+		b.dirListed = listed
 	}
 }
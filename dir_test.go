@@ -0,0 +1,34 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestDirListEscapes(t *testing.T) {
+	b := &Bucket{Name: "test", Path: "/"}
+	evil := `"><script>alert(1)</script>.txt`
+	b.dir.objects = map[string]*DirItem{
+		"up/": {Name: "up/", isDir: true, list: []*DirItem{
+			{Name: evil, Checksum: "{SHA256}00"},
+			{Name: "a b#c/", isDir: true, Checksum: "-"},
+		}},
+	}
+	ctx := &fasthttp.RequestCtx{}
+	ctx.SetUserValue("shareQuery", "?share=1&scope=%2Fup%2F")
+	dirList(b, "up/", ctx, "", "", nil, false)
+	body := string(ctx.Response.Body())
+	if strings.Contains(body, "<script>alert") {
+		t.Fatalf("name is not escaped:\n%s", body)
+	}
+	for _, want := range []string{
+		`<a href="%22%3E%3Cscript%3Ealert%281%29%3C%2Fscript%3E.txt?share=1&amp;scope=%2Fup%2F">&#34;&gt;&lt;script&gt;alert(1)&lt;/script&gt;.txt</a>`,
+		`<a href="a%20b%23c/?share=1&amp;scope=%2Fup%2F">a b#c/</a>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("listing is missing %s:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/valyala/fasthttp"
+)
+
+// The largest zip archive which is spooled to a temporary file to be unpacked
+var extractMaxSize int64 = 1 << 30
+
+// One entry of an archive, whichever the format
+type archiveEntry struct {
+	name    string
+	mode    fs.FileMode
+	size    int64
+	modTime time.Time
+	open    func() (io.ReadCloser, error)
+}
+
+// Is the POST an archive to unpack into the folder, by an "Action: extract"
+// header or an ?extract query?
+func isExtract(ctx *fasthttp.RequestCtx) bool {
+	action := strings.SplitN(b2s(ctx.Request.Header.Peek("Action")), " ", 2)[0]
+	return strings.EqualFold(action, "extract") || ctx.QueryArgs().Has("extract")
+}
+
+// Unpack a tar, tar.gz or zip archive posted to the folder, storing each file
+// in it under the folder with the modification time of the entry as its date
+// and working out its SHA256 on the way.  The format is told from the start
+// of the body.  A tar is streamed, while a zip has its index at the end, so it
+// is spooled to a temporary file first.  The files are checked and reported
+// like those of a form, and entries which would land outside of the folder are
+// refused.
+func extractUpload(ctx *fasthttp.RequestCtx, ls *liveSettings, b *Bucket, dir string, id *Identity, client rateKeys, mayUpload func(p string) bool) {
+	ctx.Response.Header.Set("Cache-Control", "no-cache")
+	contentLength := int64(ctx.Request.Header.ContentLength())
+	if contentLength < -1 {
+		ctx.Error("411 length required", fasthttp.StatusLengthRequired)
+		return
+	}
+	known := contentLength
+	if known < 0 {
+		known = 0
+	}
+	if !ls.limits.allow(ctx, "write-bytes", client, float64(known)) {
+		ctx.SetConnectionClose()
+		return
+	}
+	var body io.Reader = bytes.NewReader(nil)
+	if contentLength != 0 {
+		body = ctx.RequestBodyStream()
+	}
+
+	// Tell the format from the magic numbers at the start
+	br := bufio.NewReader(body)
+	magic, _ := br.Peek(262)
+	var next func() (*archiveEntry, error)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			ctx.Error("400 bad request: "+err.Error(), fasthttp.StatusBadRequest)
+			ctx.SetConnectionClose()
+			return
+		}
+		next = tarEntries(tar.NewReader(gz))
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")):
+		// The spool takes no more than the room left in the quota of the folder
+		limit, status, msg := extractMaxSize, fasthttp.StatusRequestEntityTooLarge,
+			fmt.Sprintf("413 request entity too large: zip archives are limited to %d bytes", extractMaxSize)
+		if room, ok := ls.quotas.room(b, dir, id); ok && room < limit {
+			limit, status, msg = room, fasthttp.StatusInsufficientStorage,
+				fmt.Sprintf("507 insufficient storage: the archive is larger than the %d bytes left in its quota", room)
+		}
+		if contentLength > limit {
+			ctx.Error(msg, status)
+			ctx.SetConnectionClose()
+			return
+		}
+		f, err := os.CreateTemp("", "extract-*.zip")
+		if err != nil {
+			log.Println("Error spooling zip archive:", err)
+			ctx.Error("500 internal server error", fasthttp.StatusInternalServerError)
+			ctx.SetConnectionClose()
+			return
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		n, err := io.Copy(f, io.LimitReader(br, limit+1))
+		if err != nil {
+			ctx.Error("400 bad request: "+err.Error(), fasthttp.StatusBadRequest)
+			ctx.SetConnectionClose()
+			return
+		}
+		if n > limit {
+			ctx.Error(msg, status)
+			ctx.SetConnectionClose()
+			return
+		}
+		zr, err := zip.NewReader(f, n)
+		if err != nil {
+			ctx.Error("400 bad request: "+err.Error(), fasthttp.StatusBadRequest)
+			return
+		}
+		next = zipEntries(zr)
+	case len(magic) == 262 && string(magic[257:262]) == "ustar":
+		next = tarEntries(tar.NewReader(br))
+	default:
+		ctx.Error("415 unsupported media type: expected a tar, tar.gz or zip archive", fasthttp.StatusUnsupportedMediaType)
+		ctx.SetConnectionClose()
+		return
+	}
+
+	// Each file gets an audit entry of its own instead of one for the request
+	audit, _ := ctx.UserValue("audit").(*auditEntry)
+	ctx.SetUserValue("audit", nil)
+
+	var (
+		results = []formResult{}
+		total   int64
+	)
+	for {
+		e, err := next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			// A broken archive ends the manifest, after what was stored so far
+			r := formResult{Status: fasthttp.StatusBadRequest, Error: "400 bad request: " + err.Error()}
+			results = append(results, r)
+			auditResult(audit, b.key(dir), r)
+			ctx.SetConnectionClose()
+			break
+		}
+		if e.mode.IsDir() {
+			continue
+		}
+		r := storeEntry(ls, b, dir, id, mayUpload, e)
+		total += r.Bytes
+		results = append(results, r)
+		auditResult(audit, b.key(dir+r.Name), r)
+	}
+	if contentLength < 0 {
+		ls.limits.charge("write-bytes", client, float64(total))
+	}
+
+	ctx.SetStatusCode(resultsStatus(results))
+	ctx.SetContentType("application/json")
+	enc := json.NewEncoder(ctx)
+	enc.SetIndent("", "  ")
+	enc.Encode(results)
+}
+
+// Walk the entries of a tar
+func tarEntries(tr *tar.Reader) func() (*archiveEntry, error) {
+	return func() (*archiveEntry, error) {
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				return nil, err
+			}
+			if hdr.Typeflag == tar.TypeXGlobalHeader {
+				// Only pax settings for the entries after it
+				continue
+			}
+			return &archiveEntry{
+				name:    hdr.Name,
+				mode:    hdr.FileInfo().Mode(),
+				size:    hdr.Size,
+				modTime: hdr.ModTime,
+				open:    func() (io.ReadCloser, error) { return io.NopCloser(tr), nil },
+			}, nil
+		}
+	}
+}
+
+// Walk the entries of a zip
+func zipEntries(zr *zip.Reader) func() (*archiveEntry, error) {
+	i := 0
+	return func() (*archiveEntry, error) {
+		if i == len(zr.File) {
+			return nil, io.EOF
+		}
+		f := zr.File[i]
+		i++
+		return &archiveEntry{
+			name:    f.Name,
+			mode:    f.Mode(),
+			size:    int64(f.UncompressedSize64),
+			modTime: f.Modified,
+			open:    f.Open,
+		}, nil
+	}
+}
+
+// The path of an archive entry inside the folder, refusing absolute paths and
+// any which climb out of it with ".."
+func entryPath(name string) (string, bool) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") || !validPath(name) {
+		return "", false
+	}
+	name = path.Clean(name)
+	return name, name != "."
+}
+
+// Store one file of an archive in the folder
+func storeEntry(ls *liveSettings, b *Bucket, dir string, id *Identity, mayUpload func(p string) bool, e *archiveEntry) formResult {
+	r := formResult{Name: e.name}
+	fail := func(status int, msg string) formResult {
+		r.Status, r.Error = status, msg
+		return r
+	}
+	name, ok := entryPath(e.name)
+	if !ok {
+		return fail(fasthttp.StatusBadRequest, "400 bad request: entry is outside of the folder")
+	}
+	r.Name = name
+	if !e.mode.IsRegular() {
+		// Links could point anywhere, devices and the like are no use in a bucket
+		return fail(fasthttp.StatusBadRequest, "400 bad request: entry is not a regular file")
+	}
+	uri := dir + name
+	if !mayUpload(b.Path + uri) {
+		return fail(fasthttp.StatusForbidden, "403 forbidden: upload of "+b.Path+uri+" is not allowed")
+	}
+	if status, msg := ls.quotas.check(b, uri, id, e.size); status != 0 {
+		return fail(status, msg)
+	}
+	body, err := e.open()
+	if err != nil {
+		return fail(fasthttp.StatusBadRequest, "400 bad request: "+err.Error())
+	}
+	defer body.Close()
+
+	// Without a checksum the input can't fail
+	in, _ := b.putInput(uri, "", nil, nil)
+	if !e.modTime.IsZero() {
+		in.Metadata["date"] = e.modTime.UTC().Format(time.DateTime)
+	}
+	if e.size != 0 && !plainEndpoint() {
+		in.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+	}
+	h := sha256.New()
+	in.ContentLength, in.Body = e.size, io.TeeReader(io.LimitReader(body, e.size), h)
+	if _, r.Bytes, err = b.upload(in); err != nil {
+		return fail(fasthttp.StatusExpectationFailed, err.Error())
+	}
+	b.recordPut(uri, r.Bytes)
+	r.Status, r.Checksum = fasthttp.StatusCreated, "{SHA256}"+hex.EncodeToString(h.Sum(nil))
+	return r
+}
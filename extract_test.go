@@ -0,0 +1,94 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func testZip(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, body := range files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(body))
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func extractRequest(body []byte, size int) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/release/?extract")
+	ctx.Request.SetBodyStream(bytes.NewReader(body), size)
+	return ctx
+}
+
+func TestExtractZipLimit(t *testing.T) {
+	b, f := newFakeS3(t)
+	saved := extractMaxSize
+	defer func() { extractMaxSize = saved }()
+	ls := &liveSettings{}
+	always := func(p string) bool { return true }
+
+	archive := testZip(t, map[string]string{"bin/tool": strings.Repeat("x", 2000), "README": "hello"})
+	extractMaxSize = int64(len(archive))
+	ctx := extractRequest(archive, -1)
+	extractUpload(ctx, ls, b, "release/", nil, nil, always)
+	if ctx.Response.StatusCode() != fasthttp.StatusCreated || f.object("release/bin/tool") == nil {
+		t.Fatalf("expected the archive to be unpacked, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	// Over the limit, whether the length is known up front or not
+	extractMaxSize = int64(len(archive)) - 1
+	for _, size := range []int{len(archive), -1} {
+		ctx = extractRequest(archive, size)
+		extractUpload(ctx, ls, b, "other/", nil, nil, always)
+		if ctx.Response.StatusCode() != fasthttp.StatusRequestEntityTooLarge {
+			t.Errorf("length %d: expected a 413, got %d", size, ctx.Response.StatusCode())
+		}
+	}
+	if f.object("other/README") != nil {
+		t.Error("an archive over the limit was unpacked")
+	}
+}
+
+func TestExtractNeedsUpload(t *testing.T) {
+	b, f := newFakeS3(t)
+	file := filepath.Join(t.TempDir(), "acl.yaml")
+	os.WriteFile(file, []byte(`
+rules:
+  - name: public
+    path: /**
+    verbs: [read, list]
+`), 0600)
+	a, err := loadACL(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedBuckets, savedLive := buckets, live.Load()
+	defer func() { buckets = savedBuckets; live.Store(savedLive) }()
+	buckets = []*Bucket{b}
+	live.Store(&liveSettings{acl: a})
+
+	// Anonymous callers pass as privileged with access rules, the rules have
+	// to allow the upload to the folder before the archive is read
+	ctx := extractRequest(testZip(t, map[string]string{"README": "hello"}), -1)
+	handler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Errorf("expected a 403, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if len(f.calls) != 0 {
+		t.Errorf("unexpected calls %v", f.calls)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/valyala/fasthttp"
+)
+
+// How one file of a form upload went
+type formResult struct {
+	Name     string
+	Status   int
+	Bytes    int64  `json:",omitempty"`
+	Checksum string `json:",omitempty"`
+	Error    string `json:",omitempty"`
+}
+
+// Is the POST a form from a browser, rather than the body of one file?
+func isFormUpload(ctx *fasthttp.RequestCtx) bool {
+	return bytes.HasPrefix(ctx.Request.Header.ContentType(), []byte("multipart/form-data"))
+}
+
+// Did the POST come from a page of this proxy?  A browser sends the Origin of
+// the page with it, and would send the login of the visitor along with a form
+// on any other site too.  Clients like curl send no Origin at all.
+func sameOrigin(ctx *fasthttp.RequestCtx) bool {
+	origin := ctx.Request.Header.Peek("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+	u, err := url.Parse(string(origin))
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, string(ctx.Host()))
+}
+
+// Store each file of a multipart/form-data POST in the folder, streaming them
+// one after the other.  The "checksum" and "date" fields before a file, or the
+// Checksum and Content-Date headers of its part, work like the headers of a
+// POST.  Every file is checked against the access rules and quotas on its
+// own, and the result of each one is reported as JSON, or as a page for a
+// browser posting the form without script.
+func formUpload(ctx *fasthttp.RequestCtx, ls *liveSettings, b *Bucket, dir string, id *Identity, client rateKeys, mayUpload func(p string) bool) {
+	ctx.Response.Header.Set("Cache-Control", "no-cache")
+	_, params, err := mime.ParseMediaType(string(ctx.Request.Header.ContentType()))
+	if err != nil || params["boundary"] == "" {
+		ctx.Error("400 bad request: invalid multipart/form-data", fasthttp.StatusBadRequest)
+		return
+	}
+	contentLength := int64(ctx.Request.Header.ContentLength())
+	known := contentLength
+	if known < 0 {
+		known = 0
+	}
+	if !ls.limits.allow(ctx, "write-bytes", client, float64(known)) {
+		ctx.SetConnectionClose()
+		return
+	}
+
+	// Each file gets an audit entry of its own instead of one for the request
+	audit, _ := ctx.UserValue("audit").(*auditEntry)
+	ctx.SetUserValue("audit", nil)
+
+	var (
+		results       []formResult
+		total         int64
+		checksum, day []byte
+	)
+	reader := multipart.NewReader(ctx.RequestBodyStream(), params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			ctx.Error("400 bad request: "+err.Error(), fasthttp.StatusBadRequest)
+			ctx.SetConnectionClose()
+			return
+		}
+		if part.FileName() == "" {
+			// A field for the next file
+			val, _ := io.ReadAll(io.LimitReader(part, 1024))
+			switch part.FormName() {
+			case "checksum":
+				checksum = bytes.TrimSpace(val)
+			case "date":
+				day = bytes.TrimSpace(val)
+			}
+			continue
+		}
+		if cs := part.Header.Get("Checksum"); cs != "" {
+			checksum = []byte(cs)
+		}
+		if d := part.Header.Get("Content-Date"); d != "" {
+			day = []byte(d)
+		}
+
+		r := storeFormFile(ls, b, dir, id, mayUpload, part, checksum, day)
+		checksum, day = nil, nil
+		total += r.Bytes
+		results = append(results, r)
+		auditResult(audit, b.key(dir+r.Name), r)
+	}
+	if contentLength < 0 {
+		ls.limits.charge("write-bytes", client, float64(total))
+	}
+	if len(results) == 0 {
+		ctx.Error("400 bad request: no files in the form", fasthttp.StatusBadRequest)
+		return
+	}
+
+	ctx.SetStatusCode(resultsStatus(results))
+	if accept := string(ctx.Request.Header.Peek("Accept")); strings.Contains(accept, "text/html") {
+		ctx.SetContentType("text/html;charset=UTF-8")
+		fmt.Fprintf(ctx, "<!DOCTYPE html>\n<html>\n <head><title>Upload to %s</title></head>\n <body>\n  <h1>Upload to %s</h1>\n  <ul>\n",
+			html.EscapeString(b.Path+dir), html.EscapeString(b.Path+dir))
+		for _, r := range results {
+			msg := r.Error
+			if msg == "" {
+				msg = fmt.Sprintf("stored, %d bytes, %s", r.Bytes, r.Checksum)
+			}
+			fmt.Fprintf(ctx, "   <li>%s: %s</li>\n", html.EscapeString(r.Name), html.EscapeString(msg))
+		}
+		fmt.Fprintf(ctx, "  </ul>\n  <a href=\".\">Back to %s</a>\n </body>\n</html>\n", html.EscapeString(b.Path+dir))
+		return
+	}
+	ctx.SetContentType("application/json")
+	enc := json.NewEncoder(ctx)
+	enc.SetIndent("", "  ")
+	enc.Encode(results)
+}
+
+// All stored is a 201, otherwise the results show which ones failed
+func resultsStatus(results []formResult) int {
+	for _, r := range results {
+		if r.Status != fasthttp.StatusCreated {
+			return fasthttp.StatusMultiStatus
+		}
+	}
+	return fasthttp.StatusCreated
+}
+
+// Write an audit entry for one of the objects stored by the request
+func auditResult(audit *auditEntry, key string, r formResult) {
+	if audit == nil || auditLog == nil {
+		return
+	}
+	entry := *audit
+	entry.Time = time.Now().UTC()
+	entry.Key, entry.Bytes, entry.Checksum = key, r.Bytes, r.Checksum
+	entry.Status, entry.Error = r.Status, r.Error
+	auditLog.write(&entry)
+}
+
+// Store one file of a form in the folder
+func storeFormFile(ls *liveSettings, b *Bucket, dir string, id *Identity, mayUpload func(p string) bool,
+	part *multipart.Part, checksum, day []byte) formResult {
+	// Only the name, not the folders of the client
+	name := path.Base(strings.ReplaceAll(part.FileName(), "\\", "/"))
+	r := formResult{Name: name}
+	fail := func(status int, msg string) formResult {
+		r.Status, r.Error = status, msg
+		return r
+	}
+	if name == "." || name == ".." || name == "/" {
+		return fail(fasthttp.StatusBadRequest, "400 bad request: invalid file name")
+	}
+	uri := dir + name
+	if !mayUpload(b.Path + uri) {
+		return fail(fasthttp.StatusForbidden, "403 forbidden: upload of "+b.Path+uri+" is not allowed")
+	}
+	if status, msg := ls.quotas.check(b, uri, id, 0); status != 0 {
+		return fail(status, msg)
+	}
+
+	contentType := part.Header.Get("Content-Type")
+	if contentType == "application/octet-stream" {
+		// What browsers send when they don't know
+		contentType = ""
+	}
+	in, err := b.putInput(uri, contentType, day, checksum)
+	if err != nil {
+		return fail(fasthttp.StatusExpectationFailed, err.Error())
+	}
+	if len(in.ChecksumAlgorithm) == 0 && !plainEndpoint() {
+		in.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
+	}
+	in.Body = part
+	if room, ok := ls.quotas.room(b, uri, id); ok {
+		in.Body = &quotaReader{r: part, left: room}
+	}
+
+	// The size of a file in a form is not known until it ends
+	r.Checksum, r.Bytes, err = b.streamUpload(in)
+	switch {
+	case err == nil:
+		b.recordPut(uri, r.Bytes)
+		r.Status = fasthttp.StatusCreated
+		return r
+	case errors.Is(err, errOverQuota):
+		return fail(fasthttp.StatusInsufficientStorage, err.Error())
+	}
+	return fail(fasthttp.StatusExpectationFailed, err.Error())
+}
+
+// The form at the bottom of a listing for those who may upload to the folder.
+// Without script it posts the picked files and shows the results page, with
+// script the files can also be dropped on it and the results are shown below
+// the form along with the progress.
+const uploadForm = ` <form id="upload" method="post" enctype="multipart/form-data" style="border:2px dashed #999;padding:1em;margin:1em 0;">
+  Drop files here or pick them: <input type="file" name="file" multiple>
+  <input type="submit" value="Upload">
+  <div id="upload-status"></div>
+ </form>
+ <script>
+(function() {
+  var form = document.getElementById("upload");
+  var status = document.getElementById("upload-status");
+  function send(files) {
+    if (!files.length) return;
+    var data = new FormData();
+    for (var i = 0; i < files.length; i++) {
+      // Keep the modification time of the file as its Content-Date
+      data.append("date", new Date(files[i].lastModified).toUTCString());
+      data.append("file", files[i], files[i].name);
+    }
+    var xhr = new XMLHttpRequest();
+    xhr.open("POST", location.pathname);
+    xhr.setRequestHeader("Accept", "application/json");
+    xhr.upload.onprogress = function(e) {
+      if (e.lengthComputable) status.textContent = "Uploading... " + Math.floor(100 * e.loaded / e.total) + "%";
+    };
+    xhr.onload = function() {
+      var results;
+      try { results = JSON.parse(xhr.responseText); } catch (e) {
+        status.textContent = xhr.responseText;
+        return;
+      }
+      status.textContent = "";
+      var list = document.createElement("ul");
+      results.forEach(function(r) {
+        var item = document.createElement("li");
+        item.textContent = r.Name + ": " + (r.Error || "stored, " + r.Bytes + " bytes, " + r.Checksum);
+        list.appendChild(item);
+      });
+      status.appendChild(list);
+    };
+    xhr.onerror = function() { status.textContent = "Upload failed"; };
+    status.textContent = "Uploading...";
+    xhr.send(data);
+  }
+  form.addEventListener("submit", function(e) {
+    e.preventDefault();
+    send(form.elements["file"].files);
+  });
+  form.addEventListener("dragover", function(e) {
+    e.preventDefault();
+    form.style.borderColor = "blue";
+  });
+  form.addEventListener("dragleave", function() { form.style.borderColor = "#999"; });
+  form.addEventListener("drop", function(e) {
+    e.preventDefault();
+    form.style.borderColor = "#999";
+    send(e.dataTransfer.files);
+  });
+})();
+ </script>
+`
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestSameOrigin(t *testing.T) {
+	tests := []struct {
+		host, origin string
+		ok           bool
+	}{
+		{"files.example.com", "", true},
+		{"files.example.com", "https://files.example.com", true},
+		{"files.example.com:8080", "http://FILES.example.com:8080", true},
+		{"files.example.com", "https://evil.example.com", false},
+		{"files.example.com:8080", "http://files.example.com", false},
+		{"files.example.com", "null", false},
+		{"files.example.com", "files.example.com", false},
+	}
+	for _, tt := range tests {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetHost(tt.host)
+		if tt.origin != "" {
+			ctx.Request.Header.Set("Origin", tt.origin)
+		}
+		if got := sameOrigin(ctx); got != tt.ok {
+			t.Errorf("origin %q on host %q: got %v", tt.origin, tt.host, got)
+		}
+	}
+}
+
+func TestFormNeedsUpload(t *testing.T) {
+	b, f := newFakeS3(t)
+	file := filepath.Join(t.TempDir(), "acl.yaml")
+	os.WriteFile(file, []byte(`
+rules:
+  - name: public
+    path: /**
+    verbs: [read, list]
+`), 0600)
+	a, err := loadACL(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedBuckets, savedLive := buckets, live.Load()
+	defer func() { buckets = savedBuckets; live.Store(savedLive) }()
+	buckets = []*Bucket{b}
+	live.Store(&liveSettings{acl: a})
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, _ := w.CreateFormFile("file", "hello.txt")
+	part.Write([]byte("hello"))
+	w.Close()
+
+	// The rules have to allow the upload to the folder before the form is read
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.SetRequestURI("/drop/")
+	ctx.Request.Header.SetContentType(w.FormDataContentType())
+	ctx.Request.SetBodyStream(bytes.NewReader(body.Bytes()), body.Len())
+	handler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Errorf("expected a 403, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if len(f.calls) != 0 {
+		t.Errorf("unexpected calls %v", f.calls)
+	}
+}
@@ -2,17 +2,17 @@ package main
 
 import (
 	"bytes"
-	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net/url"
 	"path"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/araddon/dateparse"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/valyala/fasthttp"
@@ -23,13 +23,216 @@ func handler(ctx *fasthttp.RequestCtx) {
 		log.Println("Got request:", ctx)
 	}
 
-	isPrivileged := !(len(uploadHeader) == 0 || len(ctx.Request.Header.Peek(uploadHeader)) == 0)
-
-	uri := strings.TrimPrefix(b2s(ctx.URI().Path()), "/")
+	// Grab the current settings once, a reload will not change them mid request
+	ls := live.Load()
 	method := b2s(ctx.Method())
-	var err error
+
+	// Every attempt to modify a bucket is audited, even when it is refused
+	audit := newAuditEntry(ctx, method)
+
+	// A signed share link stands in for a login, limited to its path and method
+	link, err := ls.share.check(ctx)
+	if err != nil {
+		ctx.Error("403 forbidden: "+err.Error(), fasthttp.StatusForbidden)
+		return
+	}
+
+	// Authenticated users are allowed to modify the bucket
+	var id *Identity
+	var ok bool
+	if link != nil {
+		id = link.identity()
+		// Keep the link on the entries of a shared folder listing
+		ctx.SetUserValue("shareQuery", link.query(ctx))
+	} else {
+		// Guessing passwords is limited by the failed logins from the address,
+		// checked before the password is
+		addr := rateClient(ctx, nil)
+		if len(ctx.Request.Header.Peek("Authorization")) > 0 && ls.limits.exhausted(ctx, "auth-failures", addr) {
+			return
+		}
+		if id, ok = authenticate(ctx, ls); !ok {
+			ls.limits.charge("auth-failures", addr, 1)
+			challenge(ctx, ls)
+			return
+		}
+	}
+	ctx.SetUserValue("identity", id)
+	if audit != nil {
+		audit.setIdentity(id)
+	}
+
+	// With access rules every request is checked per path, when denied the
+	// caller is asked to log in or gets a 403 naming the rule.
+	isPrivileged := id != nil || ls.acl != nil
+	host := hostName(b2s(ctx.Host()))
+	permit := func(verb, p string) bool {
+		if ok, why := ls.networks.allowed(clientIP(ctx), host, verb, p); !ok {
+			ctx.Error("403 forbidden: "+why, fasthttp.StatusForbidden)
+			return false
+		}
+		if link != nil {
+			if !link.allows(verb, p) {
+				ctx.Error("403 forbidden: share link does not allow "+verb+" on "+p, fasthttp.StatusForbidden)
+				return false
+			}
+			if denied, why := ls.acl.denied(id, host, verb, p); denied {
+				ctx.Error("403 forbidden: "+why, fasthttp.StatusForbidden)
+				return false
+			}
+			return true
+		}
+		if ls.acl == nil {
+			return true
+		}
+		ok, why := ls.acl.allowed(id, host, verb, p)
+		if !ok {
+			if id == nil && ls.authEnabled() {
+				challenge(ctx, ls)
+			} else {
+				ctx.Error("403 forbidden: "+why, fasthttp.StatusForbidden)
+			}
+		}
+		return ok
+	}
+	// Whether the caller may upload to the path, without answering the request
+	mayUpload := func(p string) bool {
+		if !isPrivileged {
+			return false
+		}
+		if ok, _ := ls.networks.allowed(clientIP(ctx), host, "upload", p); !ok {
+			return false
+		}
+		if link != nil {
+			denied, _ := ls.acl.denied(id, host, "upload", p)
+			return link.allows("upload", p) && !denied
+		}
+		if ls.acl == nil {
+			return true
+		}
+		ok, _ := ls.acl.allowed(id, host, "upload", p)
+		return ok
+	}
+	// Listings only show the entries the caller may read
+	var visible func(p string, isDir bool) bool
+	if link != nil || ls.acl != nil || ls.networks != nil {
+		visible = func(p string, isDir bool) bool {
+			verb := "read"
+			if isDir {
+				verb = "list"
+			}
+			if ok, _ := ls.networks.allowed(clientIP(ctx), host, verb, p); !ok {
+				return false
+			}
+			if link != nil {
+				denied, _ := ls.acl.denied(id, host, verb, p)
+				return link.allows(verb, p) && !denied
+			}
+			if ls.acl == nil {
+				return true
+			}
+			ok, _ := ls.acl.allowed(id, host, verb, p)
+			return ok
+		}
+	}
+
+	// Find the bucket mounted on this path
+	reqPath := b2s(ctx.URI().Path())
+	b, uri := routeBucket(b2s(ctx.Host()), reqPath)
+	if b == nil {
+		if method == "GET" && reqPath == "/" {
+			mountList(ctx, b2s(ctx.Host()), visible)
+		} else {
+			ctx.Error("404 file not found: "+reqPath, fasthttp.StatusNotFound)
+		}
+		return
+	}
+	if !strings.HasPrefix(reqPath, b.Path) {
+		// Add the trailing slash to the mount point
+		ctx.Redirect(b.Path, fasthttp.StatusTemporaryRedirect)
+		return
+	}
+	if !validPath(uri) {
+		ctx.Error("400 invalid path: "+reqPath, fasthttp.StatusBadRequest)
+		return
+	}
+	if audit != nil {
+		audit.Bucket, audit.Key = b.Name, b.key(uri)
+	}
+
+	// Rate limit the client separately for listings, downloads and changes
+	client := rateClient(ctx, id)
+	limit := "download"
+	switch {
+	case method == "PUT" || method == "DELETE" || method == "POST" || method == "PATCH":
+		limit = "write"
+	case len(uri) == 0 || uri[len(uri)-1] == '/':
+		limit = "list"
+	}
+	if !ls.limits.allow(ctx, limit, client, 1) {
+		return
+	}
+
+	// A POST needs no preflight, so any site could have a browser post a form
+	// or a file here
+	if method == "POST" && !sameOrigin(ctx) {
+		ctx.Error("403 forbidden: cross-origin POST from "+string(ctx.Request.Header.Peek("Origin")), fasthttp.StatusForbidden)
+		ctx.SetConnectionClose()
+		return
+	}
 
 	switch {
+	case method == "OPTIONS" && tusUploads != nil:
+		tusOptions(ctx)
+		return
+
+	case isPrivileged && tusUploads != nil && isTusRequest(ctx, method):
+		if method == "POST" && (len(uri) == 0 || uri[len(uri)-1] == '/') {
+			// An upload into a folder is named by its metadata
+			name := tusFilename(ctx)
+			if name == "" {
+				ctx.Error("400 bad request: a filename is needed in the Upload-Metadata", fasthttp.StatusBadRequest)
+				return
+			}
+			uri, reqPath = uri+name, reqPath+name
+			if audit != nil {
+				audit.Key = b.key(uri)
+			}
+		}
+		if !permit("upload", reqPath) {
+			return
+		}
+		tusUploads.serve(ctx, method, ls, b, uri, id, client)
+		return
+
+	case isPrivileged && method == "POST" && isExtract(ctx):
+		// An archive with any number of files for the folder
+		if len(uri) > 0 && uri[len(uri)-1] != '/' {
+			ctx.Error("400 bad request: extract the archive into a folder", fasthttp.StatusBadRequest)
+			ctx.SetConnectionClose()
+			return
+		}
+		if !permit("upload", reqPath) {
+			ctx.SetConnectionClose()
+			return
+		}
+		extractUpload(ctx, ls, b, uri, id, client, mayUpload)
+		return
+
+	case isPrivileged && method == "POST" && isFormUpload(ctx):
+		// A form from the browser, with any number of files for the folder
+		if len(uri) > 0 && uri[len(uri)-1] != '/' {
+			ctx.Error("400 bad request: post the form to a folder", fasthttp.StatusBadRequest)
+			ctx.SetConnectionClose()
+			return
+		}
+		if !permit("upload", reqPath) {
+			ctx.SetConnectionClose()
+			return
+		}
+		formUpload(ctx, ls, b, uri, id, client, mayUpload)
+		return
+
 	case isPrivileged && method == "PUT":
 		ctx.Response.Header.Set("Cache-Control", "no-cache")
 
@@ -37,14 +240,18 @@ func handler(ctx *fasthttp.RequestCtx) {
 		action := strings.SplitN(b2s(ctx.Request.Header.Peek("Action")), " ", 2)
 		switch strings.ToLower(action[0]) {
 		case "delete":
-			resp, err := s3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
-				Bucket: &bucketName,
-				Key:    &uri,
+			if !permit("delete", reqPath) {
+				return
+			}
+			resp, err := b.S3().DeleteObject(abortCtx, &s3.DeleteObjectInput{
+				Bucket: &b.Name,
+				Key:    aws.String(b.key(uri)),
 			})
 			if debug {
 				log.Printf("Delete %q %#v, err: %v", uri, resp, err)
 			}
 			if err == nil {
+				b.recordRemove(uri)
 				ctx.SetStatusCode(fasthttp.StatusGone)
 			} else {
 				ctx.Error(err.Error(), fasthttp.StatusLocked)
@@ -52,27 +259,55 @@ func handler(ctx *fasthttp.RequestCtx) {
 
 		case "copy":
 			if len(action) == 1 || len(action[1]) < 2 {
-				ctx.Error(err.Error(), fasthttp.StatusExpectationFailed)
+				ctx.Error("missing copy source", fasthttp.StatusExpectationFailed)
 				return
 			}
 			src := action[1]
+			if audit != nil {
+				audit.Source = src
+			}
+			if !permit("copy", reqPath) {
+				return
+			}
+			var size int64 // Only known for the sources in this bucket
 			switch src[0] {
-			case '/':
-				src = bucketName + src
-			case '.':
-				d, _ := path.Split(uri)
-				src = bucketName + "/" + path.Clean(d+"/"+src)
-			}
-			src = url.QueryEscape(src)
-			_, err = s3Client.CopyObject(context.TODO(), &s3.CopyObjectInput{
-				Bucket:     &bucketName,
+			case '/', '.':
+				var p string
+				if p, err = resolveSource(uri, src); err != nil {
+					ctx.Error(err.Error(), fasthttp.StatusForbidden)
+					return
+				}
+				if !permit("read", b.Path+p) {
+					return
+				}
+				size, _ = b.objectSize(p)
+				src = b.Name + "/" + b.key(p)
+			default:
+				// Copying from another bucket or an access point would reach
+				// outside of the prefix this proxy is confined to, or outside of
+				// the paths the access rules cover.
+				if b.Prefix != "" || ls.acl != nil {
+					ctx.Error("copy sources outside of the served path are not allowed", fasthttp.StatusForbidden)
+					return
+				}
+			}
+			if audit != nil {
+				audit.Source = src
+			}
+			if !ls.quotas.allow(ctx, b, uri, id, size) {
+				return
+			}
+			src = escapeCopySource(src)
+			_, err = b.S3().CopyObject(abortCtx, &s3.CopyObjectInput{
+				Bucket:     &b.Name,
 				CopySource: &src,
-				Key:        &uri,
+				Key:        aws.String(b.key(uri)),
 			})
 			if debug {
 				log.Println("copy", src, "->", uri, "err:", err)
 			}
 			if err == nil {
+				b.recordPut(uri, size)
 				ctx.SetStatusCode(fasthttp.StatusCreated)
 			} else {
 				ctx.Error(err.Error(), fasthttp.StatusLocked)
@@ -80,15 +315,22 @@ func handler(ctx *fasthttp.RequestCtx) {
 
 		case "link":
 			if len(action) == 1 || len(action[1]) < 2 || action[1][0] != '.' {
-				ctx.Error(err.Error(), fasthttp.StatusExpectationFailed)
+				ctx.Error("link target must be a relative path", fasthttp.StatusExpectationFailed)
+				return
+			}
+			if _, err = resolveSource(uri, action[1]); err != nil {
+				ctx.Error(err.Error(), fasthttp.StatusForbidden)
+				return
+			}
+			if !permit("link", reqPath) || !ls.quotas.allow(ctx, b, uri, id, 0) {
 				return
 			}
 
 			body := bytes.NewReader([]byte{})
 			inputObj := &s3.PutObjectInput{
-				Bucket:        &bucketName,
+				Bucket:        &b.Name,
 				ContentLength: int64(0),
-				Key:           &uri,
+				Key:           aws.String(b.key(uri)),
 				Body:          body,
 				Metadata:      make(map[string]string),
 			}
@@ -100,10 +342,14 @@ func handler(ctx *fasthttp.RequestCtx) {
 			}
 
 			inputObj.Metadata["link"] = action[1]
+			if audit != nil {
+				audit.Source = action[1]
+			}
 			var result *s3.PutObjectOutput
-			result, err = s3Client.PutObject(context.TODO(), inputObj)
+			result, err = b.S3().PutObject(abortCtx, inputObj)
 
 			if err == nil {
+				b.recordPut(uri, 0)
 				ctx.SetStatusCode(fasthttp.StatusCreated)
 			} else {
 				ctx.Error(err.Error(), fasthttp.StatusExpectationFailed)
@@ -115,30 +361,32 @@ func handler(ctx *fasthttp.RequestCtx) {
 
 		case "move":
 			if len(action) == 1 || len(action[1]) < 2 {
-				ctx.Error(err.Error(), fasthttp.StatusExpectationFailed)
+				ctx.Error("missing move source", fasthttp.StatusExpectationFailed)
 				return
 			}
-			src := action[1]
-			switch src[0] {
-			case '/':
-			case '.':
-				d, _ := path.Split(uri)
-				src = path.Clean(d + "/" + src)
-				if src[0] == '.' {
-					// avoid escaping the path to go to another bucket
-					ctx.Error(err.Error(), fasthttp.StatusExpectationFailed)
-					return
-				}
-			default:
-				// non-intra-bucket paths are not allowed for the move operation
-				ctx.Error("path is not relative or absolue", fasthttp.StatusExpectationFailed)
+			// Only intra-bucket paths are allowed for the move operation
+			var src string
+			if src, err = resolveSource(uri, action[1]); err != nil {
+				ctx.Error(err.Error(), fasthttp.StatusForbidden)
+				return
+			}
+			if !permit("move", reqPath) || !permit("move", b.Path+src) {
 				return
 			}
-			e_src := url.QueryEscape(bucketName + "/" + src)
-			_, err = s3Client.CopyObject(context.TODO(), &s3.CopyObjectInput{
-				Bucket:     &bucketName,
+			srcURI := src
+			size, _ := b.objectSize(srcURI)
+			if !ls.quotas.allow(ctx, b, uri, id, size) {
+				return
+			}
+			src = b.key(src)
+			if audit != nil {
+				audit.Source = b.Name + "/" + src
+			}
+			e_src := escapeCopySource(b.Name + "/" + src)
+			_, err = b.S3().CopyObject(abortCtx, &s3.CopyObjectInput{
+				Bucket:     &b.Name,
 				CopySource: &e_src,
-				Key:        &uri,
+				Key:        aws.String(b.key(uri)),
 			})
 			if debug {
 				log.Println("move", e_src, "or", src, "->", uri, "err:", err)
@@ -149,16 +397,64 @@ func handler(ctx *fasthttp.RequestCtx) {
 			}
 
 			// After it has been copied, delete the source object
-			_, err = s3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
-				Bucket: &bucketName,
+			_, err = b.S3().DeleteObject(abortCtx, &s3.DeleteObjectInput{
+				Bucket: &b.Name,
 				Key:    &src,
 			})
+			b.recordPut(uri, size)
 			if err == nil {
+				b.recordRemove(srcURI)
 				ctx.SetStatusCode(fasthttp.StatusGone)
 			} else {
 				ctx.Error(err.Error(), fasthttp.StatusLocked)
 			}
 
+		case "share":
+			if ls.share == nil || link != nil {
+				ctx.Error("share links are not enabled", fasthttp.StatusNotImplemented)
+				return
+			}
+			if !permit("share", reqPath) {
+				return
+			}
+			var args string
+			if len(action) > 1 {
+				args = action[1]
+			}
+			age, shareMethod, err := parseShareArgs(args)
+			if err != nil {
+				ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+				return
+			}
+			if shareMethod == "GET" && len(uri) > 0 && !b.isFile(uri) && !b.isDir(uri) {
+				ctx.Error("404 file not found: "+uri, fasthttp.StatusNotFound)
+				return
+			}
+			// A link can't grant more than the minter may do on the path
+			switch {
+			case shareMethod == "POST" && !permit("upload", reqPath):
+				return
+			case shareMethod == "GET" && !permit("read", reqPath):
+				return
+			case shareMethod == "GET" && strings.HasSuffix(reqPath, "/") && !permit("list", reqPath):
+				return
+			}
+			newLink, shareURL, err := ls.share.mint(b, reqPath, shareMethod, age)
+			if err != nil {
+				ctx.Error(err.Error(), fasthttp.StatusBadRequest)
+				return
+			}
+			log.Printf("Share link %s for %s %s by %s until %s", newLink.ID, newLink.Method, newLink.Scope,
+				id, newLink.Expires.UTC().Format(time.RFC3339))
+			ctx.SetStatusCode(fasthttp.StatusCreated)
+			ctx.SetContentType("application/json")
+			enc := json.NewEncoder(ctx)
+			enc.SetEscapeHTML(false)
+			enc.Encode(struct {
+				*shareLink
+				URL string
+			}{newLink, shareURL})
+
 		case "tea":
 			ctx.SetStatusCode(fasthttp.StatusTeapot)
 			ctx.Response.Header.Set("Version", Version)
@@ -170,95 +466,120 @@ func handler(ctx *fasthttp.RequestCtx) {
 
 	case isPrivileged && method == "DELETE":
 		ctx.Response.Header.Set("Cache-Control", "no-cache")
+		if !permit("delete", reqPath) {
+			return
+		}
 
-		resp, err := s3Client.DeleteObject(context.TODO(), &s3.DeleteObjectInput{
-			Bucket: &bucketName,
-			Key:    &uri,
+		resp, err := b.S3().DeleteObject(abortCtx, &s3.DeleteObjectInput{
+			Bucket: &b.Name,
+			Key:    aws.String(b.key(uri)),
 		})
 		if debug {
 			log.Printf("Delete %q %#v, err: %v", uri, resp, err)
 		}
 		if err == nil {
+			b.recordRemove(uri)
 			ctx.SetStatusCode(fasthttp.StatusGone)
 		} else {
 			ctx.Error(err.Error(), fasthttp.StatusLocked)
 		}
 
 	case isPrivileged && method == "POST":
-		contentLength, _ := strconv.Atoi(b2s(ctx.Request.Header.Peek("Content-Length")))
-		ContentType := b2s(ctx.Request.Header.Peek("Content-Type"))
-		switch ContentType {
-		case "application/x-www-form-urlencoded", "":
-			// Set some sane defaults in case the file has been uploaded with the wrong type
-			ContentType = getMime(uri)
+		if !permit("upload", reqPath) {
+			return
+		}
+		// A chunked upload has a length of -1, its size is only known once it
+		// has been read
+		contentLength := int64(ctx.Request.Header.ContentLength())
+		if contentLength < -1 {
+			ctx.Error("411 length required", fasthttp.StatusLengthRequired)
+			return
+		}
+		known := contentLength
+		if known < 0 {
+			known = 0
+		}
+		if !ls.limits.allow(ctx, "write-bytes", client, float64(known)) ||
+			!ls.quotas.allow(ctx, b, uri, id, known) {
+			if contentLength < 0 {
+				// The unread chunks would be taken for the next request
+				ctx.SetConnectionClose()
+			}
+			return
 		}
-
 		var body io.Reader
-		if contentLength > 0 {
+		if contentLength != 0 {
 			body = ctx.RequestBodyStream()
 		} else {
 			body = bytes.NewReader([]byte{})
 		}
-
-		inputObj := &s3.PutObjectInput{
-			Bucket:        &bucketName,
-			ContentLength: int64(contentLength),
-			ContentType:   &ContentType,
-			Key:           &uri,
-			Body:          body,
-			Metadata:      make(map[string]string),
+		if room, ok := ls.quotas.room(b, uri, id); ok && contentLength < 0 {
+			body = &quotaReader{r: body, left: room}
 		}
 
-		if d := ctx.Request.Header.Peek("Content-Date"); len(d) != 0 {
-			if t, err := dateparse.ParseAny(b2s(d)); err == nil {
-				inputObj.Metadata["date"] = t.Format(time.DateTime)
-			}
+		// If a checksum header is provided, unmarshall it
+		var cs []byte
+		if contentLength != 0 {
+			cs = ctx.Request.Header.Peek("Checksum")
 		}
-
-		if contentLength > 0 {
-			// If a checksum header is provided, unmarshall it
-			if cs := ctx.Request.Header.Peek("Checksum"); len(cs) != 0 {
-				unmarshalChecksum(cs, inputObj)
-				if len(inputObj.ChecksumAlgorithm) == 0 {
-					if debug {
-						log.Printf("Invalid checksum formatted string: %q", b2s(cs))
-					}
-					ctx.Error(fmt.Sprintf("Invalid checksum formatted string: %q", b2s(cs)), fasthttp.StatusExpectationFailed)
-					return
-				}
+		inputObj, err := b.putInput(uri, b2s(ctx.Request.Header.Peek("Content-Type")),
+			ctx.Request.Header.Peek("Content-Date"), cs)
+		if err != nil {
+			if debug {
+				log.Println(err)
 			}
+			ctx.Error(err.Error(), fasthttp.StatusExpectationFailed)
+			return
+		}
+		inputObj.ContentLength, inputObj.Body = contentLength, body
 
-			// If no checksum algorithm is specified, default to SHA256
-			if len(inputObj.ChecksumAlgorithm) == 0 {
-				inputObj.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
-			}
+		// If no checksum algorithm is specified, default to SHA256
+		if contentLength != 0 && len(inputObj.ChecksumAlgorithm) == 0 && !plainEndpoint() {
+			inputObj.ChecksumAlgorithm = types.ChecksumAlgorithmSha256
 		}
 
-		var result *s3.PutObjectOutput
-		result, err = s3Client.PutObject(context.TODO(), inputObj)
+		checksum, size, err := b.upload(inputObj)
+		if err == nil && contentLength < 0 {
+			ls.limits.charge("write-bytes", client, float64(size))
+		}
 
-		if err == nil {
+		switch {
+		case err == nil:
+			b.recordPut(uri, size)
 			ctx.SetStatusCode(fasthttp.StatusCreated)
-		} else {
+			ctx.Response.Header.Set("ETag", fmt.Sprintf("%q", checksum))
+			if audit != nil {
+				audit.Bytes, audit.Checksum = size, checksum
+			}
+		case errors.Is(err, errOverQuota):
+			ctx.Error(err.Error(), fasthttp.StatusInsufficientStorage)
+		default:
 			ctx.Error(err.Error(), fasthttp.StatusExpectationFailed)
 		}
-		if debug {
-			log.Printf("Upload result: %#v  err: %v\n", result, err)
+		if err != nil && contentLength < 0 {
+			ctx.SetConnectionClose()
 		}
 		return
 
 	case method == "HEAD":
-		if time.Now().Sub(bucketDirUpdate) > bucketTimeout {
-			buildDirList()
+		verb := "read"
+		if len(uri) == 0 || uri[len(uri)-1] == '/' {
+			verb = "list"
+		}
+		if !permit(verb, reqPath) {
+			return
+		}
+		if time.Now().Sub(b.dirUpdate) > bucketTimeout {
+			b.buildDirList()
 		}
 
-		obj, exist := bucketDir.objects[uri]
+		obj, exist := b.dir.objects[uri]
 		if !exist {
-			if _, exist := bucketDir.objects[uri+"/"]; exist {
+			if _, exist := b.dir.objects[uri+"/"]; exist {
 				if debug {
 					log.Printf("Error finding %s so redirecting to /%s/, err: %v\n", uri, uri, err)
 				}
-				ctx.Redirect("/"+uri+"/", fasthttp.StatusTemporaryRedirect)
+				ctx.Redirect(b.Path+uri+"/", fasthttp.StatusTemporaryRedirect)
 			} else {
 				ctx.SetStatusCode(fasthttp.StatusNotFound)
 			}
@@ -272,7 +593,7 @@ func handler(ctx *fasthttp.RequestCtx) {
 			if len(obj.Checksum) == 0 {
 				dir, _ := path.Split(uri)
 				//log.Println("get checksum", uri)
-				obj.getHead(dir)
+				obj.getHead(b, dir)
 			}
 			ctx.Response.Header.Set("Content-Length", fmt.Sprintf("%d", obj.Size))
 			ctx.Response.Header.Set("Content-Type", getMime(uri))
@@ -286,27 +607,31 @@ func handler(ctx *fasthttp.RequestCtx) {
 			if isPrivileged {
 				ctx.Response.Header.Set("Cache-Control", "no-cache")
 			}
+			if !permit("list", reqPath) {
+				return
+			}
 
-			if time.Now().Sub(bucketDirUpdate) > bucketTimeout {
-				buildDirList()
+			if time.Now().Sub(b.dirUpdate) > bucketTimeout {
+				b.buildDirList()
 			}
-			if bucketDirError != nil {
+			if b.dirError != nil {
 				ctx.Error("Error listing bucket", fasthttp.StatusInternalServerError)
 				return
 			}
 
 			// When a JSON list is requested
 			if accept := strings.SplitN(b2s(ctx.Request.Header.Peek("Accept")), ",", 2); accept[0] == "list/json" {
-				jsonList(uri, ctx,
+				jsonList(b, uri, ctx,
 					len(accept) == 2 && strings.HasPrefix(accept[1], "recursive"), // Should this be a recursive listing
+					visible,
 				)
 				return
 			}
 
 			// When a directory index is provided and is found
 			var found bool
-			for _, index := range directoryIndex {
-				if testPath := path.Join(uri, index); isFile(testPath) {
+			for _, index := range ls.directoryIndex {
+				if testPath := path.Join(uri, index); b.isFile(testPath) && (visible == nil || visible(b.Path+testPath, false)) {
 					uri = testPath
 					found = true
 					break
@@ -316,23 +641,23 @@ func handler(ctx *fasthttp.RequestCtx) {
 			if !found {
 				var header, footer string
 
-				for _, test := range directoryHeader {
-					if len(test) > 0 && test[0] == '/' && isFile(test[1:]) {
+				for _, test := range ls.directoryHeader {
+					if len(test) > 0 && test[0] == '/' && b.isFile(test[1:]) {
 						header = test[1:]
 						break
 					}
-					if testPath := path.Join(uri, test); isFile(testPath) {
+					if testPath := path.Join(uri, test); b.isFile(testPath) {
 						header = testPath
 						break
 					}
 				}
 
-				for _, test := range directoryFooter {
-					if len(test) > 0 && test[0] == '/' && isFile(test[1:]) {
+				for _, test := range ls.directoryFooter {
+					if len(test) > 0 && test[0] == '/' && b.isFile(test[1:]) {
 						footer = test[1:]
 						break
 					}
-					if testPath := path.Join(uri, test); isFile(testPath) {
+					if testPath := path.Join(uri, test); b.isFile(testPath) {
 						footer = testPath
 						break
 					}
@@ -341,15 +666,18 @@ func handler(ctx *fasthttp.RequestCtx) {
 				if debug {
 					log.Println("calling dirlist", uri, ctx, header, footer)
 				}
-				dirList(uri, ctx, header, footer)
+				dirList(b, uri, ctx, header, footer, visible, mayUpload(reqPath))
 				return
 			}
 		}
 
+		if !permit("read", b.Path+uri) {
+			return
+		}
 		var obj *s3.GetObjectOutput
-		obj, err = s3Client.GetObject(context.TODO(), &s3.GetObjectInput{
-			Bucket:       &bucketName,
-			Key:          &uri,
+		obj, err = b.S3().GetObject(abortCtx, &s3.GetObjectInput{
+			Bucket:       &b.Name,
+			Key:          aws.String(b.key(uri)),
 			ChecksumMode: types.ChecksumModeEnabled,
 		})
 		if debug {
@@ -360,6 +688,10 @@ func handler(ctx *fasthttp.RequestCtx) {
 				ctx.Redirect(link, fasthttp.StatusTemporaryRedirect)
 				return
 			}
+			if !ls.limits.allow(ctx, "download-bytes", client, float64(obj.ContentLength)) {
+				obj.Body.Close()
+				return
+			}
 
 			// Found the file, so serve it out!
 			ctx.Response.Header.SetContentLength(int(obj.ContentLength))
@@ -376,16 +708,16 @@ func handler(ctx *fasthttp.RequestCtx) {
 			// Set the Content type from the mime values
 			ctx.Response.Header.Set("Content-Type", getMime(uri))
 
-			if cs := encodeChecksum(obj); cs != "" {
+			if cs := b.objectChecksum(b.key(uri), obj); cs != "" {
 				ctx.Response.Header.Set("ETag", fmt.Sprintf("%q", cs))
 			}
 
-			ctx.SetBodyStream(obj.Body, int(obj.ContentLength))
-		} else if isDir(uri + "/") {
+			ctx.SetBodyStream(trackStream(ctx, obj.Body), int(obj.ContentLength))
+		} else if b.isDir(uri + "/") {
 			if debug {
 				log.Printf("Error finding %s so redirecting to /%s/, err: %v\n", uri, uri, err)
 			}
-			ctx.Redirect("/"+uri+"/", fasthttp.StatusTemporaryRedirect)
+			ctx.Redirect(b.Path+uri+"/", fasthttp.StatusTemporaryRedirect)
 		} else {
 			if debug {
 				log.Printf("Error finding %s, err: %v\n", uri, err)
@@ -394,6 +726,10 @@ func handler(ctx *fasthttp.RequestCtx) {
 		}
 		//return
 
+	case ls.authEnabled() && (method == "PUT" || method == "DELETE" || method == "POST" || method == "PATCH"):
+		// Ask for a login before modifying the bucket
+		challenge(ctx, ls)
+
 	default:
 		ctx.Error("405 method not allowed: "+method, fasthttp.StatusMethodNotAllowed)
 	}
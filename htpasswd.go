@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// An htpasswd file which is re-read whenever it changes on disk.  The
+// supported hash formats are bcrypt ($2y$), SHA-256 / SHA-512 crypt ($5$ and
+// $6$), Apache MD5 ($apr1$) and SHA-1 ({SHA}).
+type htpasswd struct {
+	file  string
+	mutex sync.Mutex
+	mtime time.Time
+	size  int64
+	users map[string]string
+
+	// bcrypt is slow by design, so remember the passwords which have already
+	// been verified (as a hash) until the file changes.
+	verified map[string][32]byte
+}
+
+func newHtpasswd(file string) *htpasswd {
+	return &htpasswd{file: file}
+}
+
+// Re-read the file if it changed since it was last loaded.  When the file
+// cannot be read the previously loaded users are kept.
+func (h *htpasswd) load() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.loadLocked()
+}
+
+func (h *htpasswd) loadLocked() error {
+	st, err := os.Stat(h.file)
+	if err != nil {
+		return err
+	}
+	if h.users != nil && st.ModTime().Equal(h.mtime) && st.Size() == h.size {
+		return nil
+	}
+	dat, err := os.ReadFile(h.file)
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(dat))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		user, hash, ok := strings.Cut(text, ":")
+		if !ok || user == "" {
+			log.Printf("%s:%d: expected user:hash", h.file, line)
+			continue
+		}
+		if !supportedHash(hash) {
+			log.Printf("%s:%d: unsupported hash format for user %q", h.file, line, user)
+			continue
+		}
+		users[user] = hash
+	}
+	h.users, h.mtime, h.size = users, st.ModTime(), st.Size()
+	h.verified = make(map[string][32]byte)
+	log.Println(len(users), "users loaded from", h.file)
+	return nil
+}
+
+// Check the user and password against the file, reloading it first if it was
+// changed.
+func (h *htpasswd) authenticate(user, pass string) bool {
+	h.mutex.Lock()
+	if err := h.loadLocked(); err != nil {
+		log.Println("Error loading htpasswd file:", err)
+	}
+	hash, ok := h.users[user]
+	sum := sha256.Sum256([]byte(hash + "\x00" + pass))
+	cached, seen := h.verified[user]
+	h.mutex.Unlock()
+
+	if !ok {
+		return false
+	}
+	if seen && subtle.ConstantTimeCompare(cached[:], sum[:]) == 1 {
+		return true
+	}
+	if !checkHash(hash, pass) {
+		return false
+	}
+
+	h.mutex.Lock()
+	if h.users[user] == hash {
+		h.verified[user] = sum
+	}
+	h.mutex.Unlock()
+	return true
+}
+
+func supportedHash(hash string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$", "$5$", "$6$", "$apr1$", "{SHA}"} {
+		if strings.HasPrefix(hash, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Verify a password against a hash from the htpasswd file.
+func checkHash(hash, pass string) bool {
+	var computed string
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		computed = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	case strings.HasPrefix(hash, "$5$"):
+		computed = shaCrypt(sha256.New, hash, pass)
+	case strings.HasPrefix(hash, "$6$"):
+		computed = shaCrypt(sha512.New, hash, pass)
+	case strings.HasPrefix(hash, "$apr1$"):
+		computed = apr1Crypt(hash, pass)
+	default:
+		return false
+	}
+	return computed != "" && subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1
+}
+
+// The base64 alphabet used by the crypt(3) formats
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// Encode the digest in the crypt(3) order, each group of three byte indexes
+// is written as four characters, least significant first.  An index of -1 is
+// a zero byte and the last group only gets as many characters as needed.
+func cryptEncode(sum []byte, groups [][3]int) string {
+	var sb strings.Builder
+	for i, g := range groups {
+		var w uint
+		for _, idx := range g {
+			w <<= 8
+			if idx >= 0 {
+				w |= uint(sum[idx])
+			}
+		}
+		n := 4
+		if i == len(groups)-1 {
+			switch {
+			case g[0] < 0 && g[1] < 0:
+				n = 2
+			case g[0] < 0:
+				n = 3
+			}
+		}
+		for ; n > 0; n-- {
+			sb.WriteByte(cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	return sb.String()
+}
+
+var sha256Order = [][3]int{{0, 10, 20}, {21, 1, 11}, {12, 22, 2}, {3, 13, 23}, {24, 4, 14},
+	{15, 25, 5}, {6, 16, 26}, {27, 7, 17}, {18, 28, 8}, {9, 19, 29}, {-1, 31, 30}}
+
+var sha512Order = [][3]int{{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4},
+	{47, 5, 26}, {6, 27, 48}, {28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10},
+	{53, 11, 32}, {12, 33, 54}, {34, 55, 13}, {56, 14, 35}, {15, 36, 57}, {37, 58, 16},
+	{59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41}, {-1, -1, 63}}
+
+var md5Order = [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}, {-1, -1, 11}}
+
+// Compute the SHA-256 or SHA-512 crypt of the password with the salt and
+// rounds from the given hash, as described in
+// https://www.akkadia.org/drepper/SHA-crypt.txt
+func shaCrypt(newHash func() hash.Hash, setting, pass string) string {
+	magic, rest := setting[:3], setting[3:]
+	rounds, explicitRounds := 5000, false
+	if r, ok := strings.CutPrefix(rest, "rounds="); ok {
+		n, after, found := strings.Cut(r, "$")
+		i, err := strconv.Atoi(n)
+		if !found || err != nil {
+			return ""
+		}
+		if i < 1000 {
+			i = 1000
+		} else if i > 999999999 {
+			i = 999999999
+		}
+		rounds, explicitRounds, rest = i, true, after
+	}
+	salt, _, _ := strings.Cut(rest, "$")
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+	p, s := []byte(pass), []byte(salt)
+
+	h := newHash()
+	size := h.Size()
+	h.Write(p)
+	h.Write(s)
+	h.Write(p)
+	b := h.Sum(nil)
+
+	h.Reset()
+	h.Write(p)
+	h.Write(s)
+	for n := len(p); n > 0; n -= size {
+		h.Write(b[:minInt(n, size)])
+	}
+	for n := len(p); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(p)
+		}
+	}
+	a := h.Sum(nil)
+
+	h.Reset()
+	for range p {
+		h.Write(p)
+	}
+	pBytes := repeatTo(h.Sum(nil), len(p))
+
+	h.Reset()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(s)
+	}
+	sBytes := repeatTo(h.Sum(nil), len(s))
+
+	c := a
+	for i := 0; i < rounds; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(pBytes)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(sBytes)
+		}
+		if i%7 != 0 {
+			h.Write(pBytes)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(pBytes)
+		}
+		c = h.Sum(nil)
+	}
+
+	order := sha256Order
+	if size == sha512.Size {
+		order = sha512Order
+	}
+	if explicitRounds {
+		return fmt.Sprintf("%srounds=%d$%s$%s", magic, rounds, salt, cryptEncode(c, order))
+	}
+	return magic + salt + "$" + cryptEncode(c, order)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Repeat the digest until it is n bytes long
+func repeatTo(sum []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, sum[:minInt(len(sum), n-len(out))]...)
+	}
+	return out
+}
+
+// Compute the Apache variant of the MD5 crypt, the default of the htpasswd
+// command.
+func apr1Crypt(setting, pass string) string {
+	const magic = "$apr1$"
+	salt, _, _ := strings.Cut(setting[len(magic):], "$")
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	p, s := []byte(pass), []byte(salt)
+
+	alt := md5.Sum(append(append(append([]byte{}, p...), s...), p...))
+	h := md5.New()
+	h.Write(p)
+	h.Write([]byte(magic))
+	h.Write(s)
+	for n := len(p); n > 0; n -= md5.Size {
+		h.Write(alt[:minInt(n, md5.Size)])
+	}
+	for n := len(p); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(p[:1])
+		}
+	}
+	final := h.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		h.Reset()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(final)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(final)
+		} else {
+			h.Write(p)
+		}
+		final = h.Sum(nil)
+	}
+	return magic + salt + "$" + cryptEncode(final, md5Order)
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	// How often a JWKS URL is fetched again, and how soon an unknown key ID
+	// may trigger an early fetch (for key rotation).
+	jwksRefresh    = time.Hour
+	jwksMinRefresh = time.Minute
+
+	// Allowed clock skew for the exp, nbf and iat claims
+	jwtLeeway = 30 * time.Second
+
+	jwtMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512",
+		"ES256", "ES384", "ES512", "EdDSA"}
+)
+
+// A set of public keys to check token signatures against, read from a file
+// (re-read when it changes) or from an https URL (fetched again every
+// jwksRefresh).
+type jwks struct {
+	source  string
+	mutex   sync.Mutex
+	keys    map[string]crypto.PublicKey
+	mtime   time.Time
+	fetched time.Time
+}
+
+func newJWKS(source string) *jwks {
+	return &jwks{source: source}
+}
+
+func (j *jwks) isURL() bool {
+	return strings.HasPrefix(j.source, "https://") || strings.HasPrefix(j.source, "http://")
+}
+
+// Load the keys if they are missing or out of date.  On an error the
+// previously loaded keys are kept.
+func (j *jwks) load() error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return j.loadLocked(false)
+}
+
+func (j *jwks) loadLocked(force bool) error {
+	var dat []byte
+	if j.isURL() {
+		if j.keys != nil && time.Since(j.fetched) < jwksRefresh &&
+			!(force && time.Since(j.fetched) > jwksMinRefresh) {
+			return nil
+		}
+		j.fetched = time.Now()
+		ctx, cancel := context.WithTimeout(abortCtx, 10*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, "GET", j.source, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: %s", j.source, resp.Status)
+		}
+		if dat, err = io.ReadAll(io.LimitReader(resp.Body, 1<<20)); err != nil {
+			return err
+		}
+	} else {
+		st, err := os.Stat(j.source)
+		if err != nil {
+			return err
+		}
+		if j.keys != nil && st.ModTime().Equal(j.mtime) {
+			return nil
+		}
+		if dat, err = os.ReadFile(j.source); err != nil {
+			return err
+		}
+		j.mtime = st.ModTime()
+	}
+
+	keys, err := parseJWKS(dat)
+	if err != nil {
+		return fmt.Errorf("%s: %w", j.source, err)
+	}
+	j.keys = keys
+	log.Println(len(keys), "JWT signing keys loaded from", j.source)
+	return nil
+}
+
+// Find the key for the token, the jwt.Keyfunc
+func (j *jwks) key(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if err := j.loadLocked(false); err != nil {
+		log.Println("Error loading JWKS:", err)
+	}
+	key, ok := j.keys[kid]
+	if !ok && j.isURL() {
+		// The signing key may have been rotated
+		if err := j.loadLocked(true); err != nil {
+			log.Println("Error loading JWKS:", err)
+		}
+		key, ok = j.keys[kid]
+	}
+	if !ok && kid == "" && len(j.keys) == 1 {
+		// A token without a key ID is fine when there is only one key
+		for _, key = range j.keys {
+			ok = true
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// A JSON Web Key, only the public key members are used
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Parse a JWKS document ({"keys": [...]}) into public keys by key ID.  Keys
+// which are not for signatures or of an unknown type are skipped.
+func parseJWKS(dat []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(dat, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("keys[%d] %q: %w", i, k.Kid, err)
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys found")
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := jwkInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := jwkInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || n.BitLen() < 2048 {
+			return nil, errors.New("invalid or weak RSA key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := jwkInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := jwkInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+func jwkInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid base64url integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// Validates bearer tokens and maps the claims to an identity
+type jwtVerifier struct {
+	keys        *jwks
+	parser      *jwt.Parser
+	userClaim   string
+	groupsClaim string
+}
+
+func newJWTVerifier(keys *jwks, issuer, audience, userClaim, groupsClaim string) *jwtVerifier {
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(jwtMethods),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(jwtLeeway),
+	}
+	if issuer != "" {
+		opts = append(opts, jwt.WithIssuer(issuer))
+	}
+	if audience != "" {
+		opts = append(opts, jwt.WithAudience(audience))
+	}
+	return &jwtVerifier{
+		keys:        keys,
+		parser:      jwt.NewParser(opts...),
+		userClaim:   userClaim,
+		groupsClaim: groupsClaim,
+	}
+}
+
+// Check the signature, expiry, issuer and audience of the token and return
+// the identity named by the user and groups claims.
+func (v *jwtVerifier) authenticate(tokenString string) (*Identity, error) {
+	claims := jwt.MapClaims{}
+	if _, err := v.parser.ParseWithClaims(tokenString, claims, v.keys.key); err != nil {
+		return nil, err
+	}
+	user, ok := claimValue(claims, v.userClaim).(string)
+	if !ok || user == "" {
+		return nil, fmt.Errorf("token has no %q claim", v.userClaim)
+	}
+	id := &Identity{User: user, Method: "jwt"}
+	switch g := claimValue(claims, v.groupsClaim).(type) {
+	case string:
+		id.Groups = strings.Fields(g)
+	case []interface{}:
+		for _, v := range g {
+			if s, ok := v.(string); ok {
+				id.Groups = append(id.Groups, s)
+			}
+		}
+	}
+	return id, nil
+}
+
+// Look up a claim, nested claims can be reached with a dotted path like
+// "realm_access.roles".
+func claimValue(claims map[string]interface{}, name string) interface{} {
+	if v, ok := claims[name]; ok || !strings.Contains(name, ".") {
+		return v
+	}
+	first, rest, _ := strings.Cut(name, ".")
+	if sub, ok := claims[first].(map[string]interface{}); ok {
+		return claimValue(sub, rest)
+	}
+	return nil
+}
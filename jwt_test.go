@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Locally made signing keys, with their public halves in a JWKS file
+type testKeys struct {
+	rsa  *rsa.PrivateKey
+	ec   *ecdsa.PrivateKey
+	ed   ed25519.PrivateKey
+	file string
+}
+
+func newTestKeys(t *testing.T) *testKeys {
+	t.Helper()
+	k := &testKeys{}
+	var err error
+	if k.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	if k.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	var edPub ed25519.PublicKey
+	if edPub, k.ed, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		t.Fatal(err)
+	}
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	set := map[string][]jwk{"keys": {
+		{Kty: "RSA", Kid: "rsa1", Use: "sig", N: b64(k.rsa.N.Bytes()), E: b64(big.NewInt(int64(k.rsa.E)).Bytes())},
+		{Kty: "EC", Kid: "ec1", Crv: "P-256", X: b64(k.ec.X.Bytes()), Y: b64(k.ec.Y.Bytes())},
+		{Kty: "OKP", Kid: "ed1", Crv: "Ed25519", X: b64(edPub)},
+	}}
+	dat, _ := json.Marshal(set)
+	k.file = filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(k.file, dat, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestJWTAuthenticate(t *testing.T) {
+	keys := newTestKeys(t)
+	v := newJWTVerifier(newJWKS(keys.file), "https://issuer.example.com", "bucket-http-proxy", "sub", "groups")
+	nested := newJWTVerifier(newJWKS(keys.file), "https://issuer.example.com", "", "sub", "realm_access.roles")
+
+	now := time.Now()
+	claims := func(extra jwt.MapClaims) jwt.MapClaims {
+		c := jwt.MapClaims{
+			"sub": "alice",
+			"iss": "https://issuer.example.com",
+			"aud": "bucket-http-proxy",
+			"exp": now.Add(time.Hour).Unix(),
+			"iat": now.Unix(),
+		}
+		for k, val := range extra {
+			if val == nil {
+				delete(c, k)
+			} else {
+				c[k] = val
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		verifier *jwtVerifier
+		token    string
+		err      string
+		groups   []string
+	}{
+		{name: "rsa with a list of groups", token: signToken(t, jwt.SigningMethodRS256, keys.rsa, "rsa1",
+			claims(jwt.MapClaims{"groups": []string{"dev", "ops"}})), groups: []string{"dev", "ops"}},
+		{name: "ecdsa with a string of groups", token: signToken(t, jwt.SigningMethodES256, keys.ec, "ec1",
+			claims(jwt.MapClaims{"groups": "dev ops"})), groups: []string{"dev", "ops"}},
+		{name: "ed25519 without groups", token: signToken(t, jwt.SigningMethodEdDSA, keys.ed, "ed1", claims(nil))},
+		{name: "nested groups claim", verifier: nested, token: signToken(t, jwt.SigningMethodRS256, keys.rsa, "rsa1",
+			claims(jwt.MapClaims{"realm_access": map[string]interface{}{"roles": []string{"admin"}}})), groups: []string{"admin"}},
+		{name: "expired", token: signToken(t, jwt.SigningMethodRS256, keys.rsa, "rsa1",
+			claims(jwt.MapClaims{"exp": now.Add(-time.Hour).Unix()})), err: "expired"},
+		{name: "expired within the leeway", token: signToken(t, jwt.SigningMethodRS256, keys.rsa, "rsa1",
+			claims(jwt.MapClaims{"exp": now.Add(-10 * time.Second).Unix()}))},
+		{name: "no expiry", token: signToken(t, jwt.SigningMethodRS256, keys.rsa, "rsa1",
+			claims(jwt.MapClaims{"exp": nil})), err: "exp"},
+		{name: "not valid yet", token: signToken(t, jwt.SigningMethodRS256, keys.rsa, "rsa1",
+			claims(jwt.MapClaims{"nbf": now.Add(time.Hour).Unix()})), err: "not valid yet"},
+		{name: "wrong issuer", token: signToken(t, jwt.SigningMethodRS256, keys.rsa, "rsa1",
+			claims(jwt.MapClaims{"iss": "https://other.example.com"})), err: "issuer"},
+		{name: "wrong audience", token: signToken(t, jwt.SigningMethodRS256, keys.rsa, "rsa1",
+			claims(jwt.MapClaims{"aud": "some-other-service"})), err: "audience"},
+		{name: "no audience", token: signToken(t, jwt.SigningMethodRS256, keys.rsa, "rsa1",
+			claims(jwt.MapClaims{"aud": nil})), err: "aud"},
+		{name: "key of another type than the alg", token: signToken(t, jwt.SigningMethodRS256, keys.rsa, "ec1",
+			claims(nil)), err: "key is of invalid type"},
+		{name: "hmac alg", token: signToken(t, jwt.SigningMethodHS256, []byte("secret"), "rsa1",
+			claims(nil)), err: "signing method HS256 is invalid"},
+		{name: "unknown kid", token: signToken(t, jwt.SigningMethodRS256, keys.rsa, "rsa2",
+			claims(nil)), err: "unknown signing key"},
+		{name: "no kid with several keys", token: signToken(t, jwt.SigningMethodRS256, keys.rsa, "",
+			claims(nil)), err: "unknown signing key"},
+		{name: "signed by another key", token: func() string {
+			other, _ := rsa.GenerateKey(rand.Reader, 2048)
+			return signToken(t, jwt.SigningMethodRS256, other, "rsa1", claims(nil))
+		}(), err: "verification error"},
+		{name: "no user", token: signToken(t, jwt.SigningMethodRS256, keys.rsa, "rsa1",
+			claims(jwt.MapClaims{"sub": nil})), err: `no "sub" claim`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier := v
+			if tt.verifier != nil {
+				verifier = tt.verifier
+			}
+			id, err := verifier.authenticate(tt.token)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected an error with %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id.User != "alice" || id.Method != "jwt" || !reflect.DeepEqual(id.Groups, tt.groups) {
+				t.Errorf("unexpected identity %+v", id)
+			}
+		})
+	}
+}
+
+func TestJWTNeedsIssuerOrAudience(t *testing.T) {
+	keys := newTestKeys(t)
+	tests := []struct {
+		issuer, audience string
+		ok               bool
+	}{
+		{"", "", false},
+		{"https://issuer.example.com", "", true},
+		{"", "bucket-http-proxy", true},
+		{"https://issuer.example.com", "bucket-http-proxy", true},
+	}
+	for _, tt := range tests {
+		t.Setenv("JWT_JWKS", keys.file)
+		t.Setenv("JWT_ISSUER", tt.issuer)
+		t.Setenv("JWT_AUDIENCE", tt.audience)
+		_, errs := loadConfig("")
+		var found bool
+		for _, err := range errs {
+			found = found || strings.Contains(err.Error(), "JWT_JWKS needs")
+		}
+		if found == tt.ok {
+			t.Errorf("issuer %q and audience %q: errors %v", tt.issuer, tt.audience, errs)
+		}
+	}
+}
@@ -5,9 +5,11 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"strings"
 	"unsafe"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
@@ -70,6 +72,16 @@ func unquote(s string) string {
 	return s
 }
 
+// Escape a bucket/key pair for use as a copy source.  The path separators are
+// kept as is so S3 compatible stores decode the source the same way AWS does.
+func escapeCopySource(src string) string {
+	parts := strings.Split(src, "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	return strings.Join(parts, "/")
+}
+
 func marshalChecksum(obj interface{}) string {
 	var cs Checksum
 	switch t := obj.(type) {
@@ -112,6 +124,12 @@ func encodeChecksum(obj interface{}) string {
 		cs.ChecksumSHA1 = t.ChecksumSHA1
 		cs.ChecksumSHA256 = t.ChecksumSHA256
 		etag = *t.ETag
+	case *s3.PutObjectOutput:
+		cs.ChecksumCRC32 = t.ChecksumCRC32
+		cs.ChecksumCRC32C = t.ChecksumCRC32C
+		cs.ChecksumSHA1 = t.ChecksumSHA1
+		cs.ChecksumSHA256 = t.ChecksumSHA256
+		etag = aws.ToString(t.ETag)
 	case *s3.GetObjectAttributesOutput:
 		if t.Checksum != nil {
 			cs.ChecksumCRC32 = t.Checksum.ChecksumCRC32
@@ -123,24 +141,48 @@ func encodeChecksum(obj interface{}) string {
 	default:
 		return "failed to match"
 	}
+	if sum, ok := checksumMetadata(obj); ok {
+		// The checksum of the whole of a multipart upload
+		return sum
+	}
 	if cs.ChecksumSHA256 != nil {
-		sDec, _ := base64.StdEncoding.DecodeString(*cs.ChecksumSHA256)
-		return fmt.Sprintf("{SHA256}%02x", sDec)
+		return "{SHA256}" + hexChecksum(*cs.ChecksumSHA256)
 	} else if cs.ChecksumSHA1 != nil {
-		sDec, _ := base64.StdEncoding.DecodeString(*cs.ChecksumSHA1)
-		return fmt.Sprintf("{SHA}%02x", sDec)
+		return "{SHA}" + hexChecksum(*cs.ChecksumSHA1)
 	} else if cs.ChecksumCRC32C != nil {
-		sDec, _ := base64.StdEncoding.DecodeString(*cs.ChecksumCRC32C)
-		return fmt.Sprintf("{CRC32C}%02x", sDec)
+		return "{CRC32C}" + hexChecksum(*cs.ChecksumCRC32C)
 	} else if cs.ChecksumCRC32 != nil {
-		sDec, _ := base64.StdEncoding.DecodeString(*cs.ChecksumCRC32)
-		return fmt.Sprintf("{CRC32}%02x", sDec)
+		return "{CRC32}" + hexChecksum(*cs.ChecksumCRC32)
 	} else if len(etag) > 0 {
 		return "{AWS-MD}" + unquote(etag)
 	}
 	return "-"
 }
 
+// Convert a base64 checksum to hex.  The checksum of a multipart upload is a
+// checksum of the part checksums followed by the number of parts, like
+// "base64-12", and keeps the suffix.
+func hexChecksum(s string) string {
+	s, parts, composite := strings.Cut(s, "-")
+	sDec, _ := base64.StdEncoding.DecodeString(s)
+	if composite {
+		return fmt.Sprintf("%02x-%s", sDec, parts)
+	}
+	return fmt.Sprintf("%02x", sDec)
+}
+
+// The checksum kept in the metadata of an object uploaded in parts
+func checksumMetadata(obj interface{}) (string, bool) {
+	var sum string
+	switch t := obj.(type) {
+	case *s3.HeadObjectOutput:
+		sum = t.Metadata["checksum"]
+	case *s3.GetObjectOutput:
+		sum = t.Metadata["checksum"]
+	}
+	return sum, sum != ""
+}
+
 func unmarshalChecksum(dat []byte, obj interface{}) {
 	var cs Checksum
 	switch t := obj.(type) {
@@ -2,103 +2,152 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/credentials/ec2rolecreds"
-	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/valyala/fasthttp"
 )
 
 var (
 	//credentials                    aws.Credentials
-	bucketName                                       string
-	uploadHeader                                     string
-	debug                                            bool
-	Version                                          string
-	s3Client                                         *s3.Client
-	directoryIndex, directoryHeader, directoryFooter []string
-	imdsClient                                       *imds.Client
+	debug     bool
+	Version   string
+	awsConfig aws.Config
 )
 
-func getIMDS() (region, ARN, ID string) {
-	/*sdkConfig, err := config.LoadDefaultConfig(context.TODO())
-	if err != nil {
-		log.Fatal("Could not load default config,", err)
-	}*/
-
-	imdsClient = imds.New(imds.Options{})
-	gro, err := imdsClient.GetRegion(context.TODO(), &imds.GetRegionInput{})
-	if err != nil {
-		log.Fatal("Could not get region property,", err)
+func main() {
+	cmd, args := parseArgs(os.Args[1:])
+	if cmd == "check-config" {
+		os.Exit(checkConfig(args))
 	}
-
-	iam, err := imdsClient.GetIAMInfo(context.TODO(), &imds.GetIAMInfoInput{})
-	if err != nil {
-		log.Fatal("Could not get IAM property,", err)
+	if len(args) > 0 {
+		log.Fatalf("Unexpected argument %q, see --help", args[0])
 	}
 
-	return gro.Region, iam.IAMInfo.InstanceProfileArn, iam.IAMInfo.InstanceProfileID
-}
+	initMimeTypes()
 
-func main() {
 	// Bucket configuration
 	fmt.Println("Bucket-HTTP-Proxy", Version, "(github.com/pschou/bucket-http-proxy)")
-	fmt.Println("Environment variables:")
-	bucketName = Env("BUCKET_NAME", "my-bucket", "The name of the bucket to be served")
+	conf, errs := loadConfig(configFile)
+	fmt.Println("Configuration:")
+	conf.Print(os.Stdout)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Println("Config error:", err)
+		}
+		os.Exit(1)
+	}
+
+	setBuckets(conf.Buckets)
+	region := conf.Get("BUCKET_REGION")
+	s3Endpoint = conf.Get("S3_ENDPOINT")
+	s3PathStyle = conf.Bool("S3_PATH_STYLE")
+	s3InsecureSkipVerify = conf.Bool("S3_INSECURE_SKIP_VERIFY")
 
 	// Service configuration
-	listenAddr := Env("LISTEN", ":8080", "The listening port to serve the contents of the bucket from")
-	refreshTime, err := time.ParseDuration(Env("REFRESH", "20m", "The refresh interval for grabbing new AMI credentials"))
-	if err != nil {
-		fmt.Println(err)
-		return
+	listenAddr := conf.Get("LISTEN")
+	refreshTime := conf.Duration("REFRESH")
+	refreshFailLimit = conf.Int("REFRESH_FAILURES")
+	adminAddr := conf.Get("ADMIN_LISTEN")
+	shutdownGrace := conf.Duration("SHUTDOWN_GRACE")
+	multipartThreshold, _ = parseSize(conf.Get("MULTIPART_THRESHOLD"))
+	multipartPartSize, _ = parseSize(conf.Get("MULTIPART_PART_SIZE"))
+	multipartConcurrency = conf.Int("MULTIPART_CONCURRENCY")
+	extractMaxSize, _ = parseSize(conf.Get("EXTRACT_MAX_SIZE"))
+	applyLive(conf)
+	if auth := live.Load().htpasswd; auth != nil {
+		if err := auth.load(); err != nil {
+			log.Fatal("Error loading htpasswd file: ", err)
+		}
+	}
+	if verifier := live.Load().jwt; verifier != nil {
+		if err := verifier.keys.load(); err != nil {
+			log.Fatal("Error loading JWKS: ", err)
+		}
+	}
+	if conf.Source("SSL_CERT_FILE") == sourceFile {
+		// The CA chain is read from the environment on first use
+		os.Setenv("SSL_CERT_FILE", conf.Get("SSL_CERT_FILE"))
 	}
-	directoryIndex = strings.Fields(Env("DIRECTORY_INDEX", "", "Which file to use for a directory index, for example: \"index.html index.htm\""))
-	directoryHeader = strings.Fields(Env("DIRECTORY_HEADER", "", "If an html file is specified it will be prepended to the directory listing, for example: \"header.html\""))
-	directoryFooter = strings.Fields(Env("DIRECTORY_FOOTER", "", "Like header but appended to the directory listing, for example: \"footer.html\" or \"/.footer.html\" for an absolute path"))
-	uploadHeader = Env("MODIFY_ALLOW_HEADER", "", "Look for this header in the request to allow bucket write permissions")
-	Env("SSL_CERT_FILE", "", "Override the system CA chain default with this CA file")
 
-	// Turn on or off debugging
-	debug = Env("DEBUG", "false", "Turn on debugging output for evaluating what is happening") != "false"
+	var tlsConfig *tls.Config
+	if certFile := conf.Get("TLS_CERT_FILE"); certFile != "" {
+		var err error
+		tlsConfig, err = newTLSConfig(certFile, conf.Get("TLS_KEY_FILE"),
+			conf.Get("TLS_CLIENT_CA_FILE"), conf.Bool("TLS_CLIENT_CERT_REQUIRED"))
+		if err != nil {
+			log.Fatal("Error loading TLS config: ", err)
+		}
+	}
 
-	fmt.Println("EC2 Environment:")
-	region, arn, id := getIMDS()
-	fmt.Println("  AWS_REGION:", region)
-	fmt.Println("  IMDS_ARN:", arn)
-	fmt.Println("  IMDS_ID:", id)
+	if file := conf.Get("AUDIT_LOG"); file != "" {
+		maxSize, _ := parseSize(conf.Get("AUDIT_MAX_SIZE"))
+		var err error
+		auditLog, err = newAuditWriter(file, maxSize, conf.Duration("AUDIT_MAX_AGE"), conf.Get("AUDIT_MIRROR_PATH"))
+		if err != nil {
+			log.Fatal("Error opening audit log: ", err)
+		}
+	}
 
-	getConfig := func() error {
-		// Get a credential provider from the configured role attached to the currently running EC2 instance
-		provider := ec2rolecreds.New(func(o *ec2rolecreds.Options) {
-			o.Client = imdsClient
-		})
+	if dir := conf.Get("TUS_STATE_DIR"); dir != "" {
+		var err error
+		if tusUploads, err = newTusStore(dir, conf.Duration("TUS_MAX_AGE")); err != nil {
+			log.Fatal("Error opening the tus state directory: ", err)
+		}
+	}
 
-		// Construct a client, wrap the provider in a cache, and supply the region for the desired service
-		s3Client = s3.New(s3.Options{
-			Credentials: aws.NewCredentialsCache(provider),
-			Region:      region,
-		})
-		//fmt.Printf("config: %#v\n\n", sdkConfig)
+	// Turn on or off debugging
+	debug = conf.Bool("DEBUG")
 
-		return nil
+	getConfig := func() error {
+		// Walk the credential chain (env, profile, web identity, ECS, IMDS), the
+		// returned provider is already wrapped in a credentials cache.
+		cfg, err := loadAWSConfig(context.TODO(), region)
+		if err != nil {
+			for _, b := range buckets {
+				b.refreshFailed(err)
+			}
+			return err
+		}
+		awsConfig = cfg
+
+		// Construct a client for each bucket using the resolved credentials and
+		// region, a bucket which fails keeps its previous client.
+		var errs []error
+		for _, b := range buckets {
+			if err := b.connect(context.TODO(), cfg); err != nil {
+				b.refreshFailed(err)
+				errs = append(errs, fmt.Errorf("bucket %s: %w", b.Name, err))
+			}
+		}
+		return errors.Join(errs...)
 	}
 
-	fmt.Println("Testing call to AWS...")
+	fmt.Println("AWS Environment:")
 	if err := getConfig(); err != nil {
-		log.Fatal("Error getting config:", err)
+		log.Fatal("Error getting config: ", err)
+	}
+	if err := describeCredentials(context.TODO(), awsConfig); err != nil {
+		log.Fatal("Error getting credentials: ", err)
 	}
-	buildDirList()
-	if bucketDirError != nil {
-		log.Fatal("Error listing bucket:", bucketDirError)
+
+	fmt.Println("Testing call to AWS...")
+	for _, b := range buckets {
+		b.buildDirList()
+		if b.dirError != nil {
+			log.Fatalf("Error listing bucket %s: %v", b.Name, b.dirError)
+		}
+		fmt.Println("Success!  Found", b.dir.count, "objects using", b.dir.size, "in", b.Name+"/"+b.Prefix, "mounted on", b.Host+b.Path)
+		if id := b.credStatus().Identity; id != "" {
+			fmt.Println("  Assumed role identity:", id)
+		}
 	}
-	fmt.Println("Success!  Found", bucketDir.count, "objects using", bucketDir.size)
 
 	/*
 		result, err := s3Client.ListBuckets(context.TODO(), &s3.ListBucketsInput{})
@@ -118,34 +167,53 @@ func main() {
 		// and recovery should the server not have a policy assigned to it yet.
 		for {
 			if debug {
-				log.Printf("creds %#v\n", s3Client)
+				log.Printf("creds %#v\n", awsConfig.Credentials)
 			}
 			time.Sleep(refreshTime)
-			getConfig()
+			if err := getConfig(); err != nil {
+				log.Println("Error refreshing credentials:", err)
+			}
 		}
 	}()
 
+	// Allow the directory and mime settings to be reloaded without a restart
+	watchReload()
+	if adminAddr != "" {
+		go serveAdmin(adminAddr)
+	}
+
 	// Create custom server.
 	s := &fasthttp.Server{
-		Handler: handler,
+		Handler: trackRequests(auditRequests(handler)),
 
 		// Every response will contain 'Server: My super server' header.
 		Name: "Bucket-HTTP-Proxy (github.com/pschou/bucket-http-proxy)",
 
 		// Turn on upload streaming
 		StreamRequestBody: true,
-	}
-	log.Printf("Listening for HTTP connections on %s", listenAddr)
-	err = s.ListenAndServe(listenAddr)
-	log.Printf("Error: %s", err)
-}
 
-func Env(env, def, usage string) string {
-	fmt.Println("  #", usage)
-	if e := os.Getenv(env); len(e) > 0 {
-		fmt.Printf("  %s=%q\n", usage, env, e)
-		return e
+		// Stream the files of a form too, instead of spooling them to disk first
+		DisablePreParseMultipartForm: true,
+	}
+	done := shutdownOnSignal(s, shutdownGrace)
+	ln, err := net.Listen("tcp4", listenAddr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if conf.Bool("PROXY_PROTOCOL") {
+		ln = proxyListener{ln}
+	}
+	if tlsConfig != nil {
+		s.TLSConfig = tlsConfig
+		log.Printf("Listening for HTTPS connections on %s", listenAddr)
+		err = s.ServeTLS(ln, "", "")
+	} else {
+		log.Printf("Listening for HTTP connections on %s", listenAddr)
+		err = s.Serve(ln)
+	}
+	if err != nil {
+		log.Printf("Error: %s", err)
+		return
 	}
-	fmt.Printf("  %s=%q (default)\n", env, def)
-	return def
+	<-done
 }
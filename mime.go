@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 )
 
 var typeFiles = []string{
@@ -16,22 +17,33 @@ var typeFiles = []string{
 	"./mime.types",
 }
 var (
-	mime = make(map[string]string)
+	mimeTypes atomic.Pointer[map[string]string]
 )
 
 func getMime(uri string) (ContentType string) {
 	ext := strings.ToLower(filepath.Ext(uri))
 	var ok bool
-	if ContentType, ok = mime[ext]; ok {
+	if ContentType, ok = (*mimeTypes.Load())[ext]; ok {
 		return
 	}
 	return "application/octet-stream"
 }
 
-func loadMimeFile(filename string) {
+// Build a new mime table from all the type files which are found.
+func loadMimeTypes() (map[string]string, error) {
+	mime := make(map[string]string)
+	for _, filename := range typeFiles {
+		if err := loadMimeFile(filename, mime); err != nil {
+			return nil, err
+		}
+	}
+	return mime, nil
+}
+
+func loadMimeFile(filename string, mime map[string]string) error {
 	f, err := os.Open(filename)
 	if err != nil {
-		return
+		return nil
 	}
 	defer f.Close()
 
@@ -61,13 +73,15 @@ func loadMimeFile(filename string) {
 	if count > 0 {
 		log.Println(count, "mime types loaded from", filename)
 	}
-	if err := scanner.Err(); err != nil {
-		panic(err)
-	}
+	return scanner.Err()
 }
 
-func init() {
-	for _, filename := range typeFiles {
-		loadMimeFile(filename)
+// Load the initial mime table, this is done once the command line has been
+// parsed so --help and --version stay quiet.
+func initMimeTypes() {
+	mime, err := loadMimeTypes()
+	if err != nil {
+		log.Fatal("Error loading mime types: ", err)
 	}
+	mimeTypes.Store(&mime)
 }
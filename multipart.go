@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// Uploads larger than the threshold are sent as a multipart upload, in parts
+// of the part size with up to the concurrency parts in flight.
+var (
+	multipartThreshold   int64 = 100 << 20
+	multipartPartSize    int64 = 64 << 20
+	multipartConcurrency       = 4
+)
+
+// S3 allows at most 10000 parts, of 5M up to 5G each
+const (
+	multipartMaxParts = 10000
+	multipartMinPart  = 5 << 20
+	multipartMaxPart  = 5 << 30
+)
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+func checkPartSize(v string) error {
+	n, err := parseSize(v)
+	if err != nil {
+		return err
+	}
+	if n < multipartMinPart || n > multipartMaxPart {
+		return errors.New("must be between 5M and 5G")
+	}
+	return nil
+}
+
+func newChecksumHash(alg types.ChecksumAlgorithm) hash.Hash {
+	switch alg {
+	case types.ChecksumAlgorithmSha1:
+		return sha1.New()
+	case types.ChecksumAlgorithmCrc32:
+		return crc32.NewIEEE()
+	case types.ChecksumAlgorithmCrc32c:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	}
+	return sha256.New()
+}
+
+// The name of the algorithm as used in the Checksum header and the ETag
+func checksumName(alg types.ChecksumAlgorithm) string {
+	switch alg {
+	case types.ChecksumAlgorithmSha1:
+		return "SHA"
+	case types.ChecksumAlgorithmCrc32:
+		return "CRC32"
+	case types.ChecksumAlgorithmCrc32c:
+		return "CRC32C"
+	}
+	return "SHA256"
+}
+
+// The base64 checksum asked for in the upload, if any
+func wantedChecksum(in *s3.PutObjectInput) string {
+	switch in.ChecksumAlgorithm {
+	case types.ChecksumAlgorithmSha1:
+		return aws.ToString(in.ChecksumSHA1)
+	case types.ChecksumAlgorithmCrc32:
+		return aws.ToString(in.ChecksumCRC32)
+	case types.ChecksumAlgorithmCrc32c:
+		return aws.ToString(in.ChecksumCRC32C)
+	case types.ChecksumAlgorithmSha256:
+		return aws.ToString(in.ChecksumSHA256)
+	}
+	return ""
+}
+
+// Set the checksum of a part for S3 to verify
+func setPartChecksum(in *s3.UploadPartInput, alg types.ChecksumAlgorithm, sum string) {
+	in.ChecksumAlgorithm = alg
+	switch alg {
+	case types.ChecksumAlgorithmSha1:
+		in.ChecksumSHA1 = &sum
+	case types.ChecksumAlgorithmCrc32:
+		in.ChecksumCRC32 = &sum
+	case types.ChecksumAlgorithmCrc32c:
+		in.ChecksumCRC32C = &sum
+	default:
+		in.ChecksumSHA256 = &sum
+	}
+}
+
+// Start a multipart upload for the put.  The checksum asked for is kept in the
+// metadata, as S3 only has the checksum of the part checksums.  Without one it
+// is tagged by tagChecksum once the upload is done.
+func (b *Bucket) createMultipart(in *s3.PutObjectInput, alg types.ChecksumAlgorithm) (string, error) {
+	create := &s3.CreateMultipartUploadInput{
+		Bucket:      in.Bucket,
+		Key:         in.Key,
+		ContentType: in.ContentType,
+		Metadata:    in.Metadata,
+	}
+	if want := wantedChecksum(in); want != "" {
+		sum, _ := base64.StdEncoding.DecodeString(want)
+		create.Metadata["checksum"] = fmt.Sprintf("{%s}%02x", checksumName(alg), sum)
+	}
+	if !plainEndpoint() {
+		create.ChecksumAlgorithm = alg
+	}
+	mu, err := b.S3().CreateMultipartUpload(abortCtx, create)
+	if err != nil {
+		return "", err
+	}
+	return aws.ToString(mu.UploadId), nil
+}
+
+// Send one part, with its checksum for S3 to verify
+func (b *Bucket) uploadPart(key, uploadID string, n int32, chunk []byte, alg types.ChecksumAlgorithm) (types.CompletedPart, error) {
+	part := &s3.UploadPartInput{
+		Bucket:        &b.Name,
+		Key:           &key,
+		UploadId:      &uploadID,
+		PartNumber:    n,
+		ContentLength: int64(len(chunk)),
+		Body:          bytes.NewReader(chunk),
+	}
+	if !plainEndpoint() {
+		h := newChecksumHash(alg)
+		h.Write(chunk)
+		setPartChecksum(part, alg, base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	}
+	out, err := b.S3().UploadPart(abortCtx, part)
+	if err != nil {
+		return types.CompletedPart{}, fmt.Errorf("part %d: %w", n, err)
+	}
+	return types.CompletedPart{
+		PartNumber:     n,
+		ETag:           out.ETag,
+		ChecksumCRC32:  out.ChecksumCRC32,
+		ChecksumCRC32C: out.ChecksumCRC32C,
+		ChecksumSHA1:   out.ChecksumSHA1,
+		ChecksumSHA256: out.ChecksumSHA256,
+	}, nil
+}
+
+func (b *Bucket) completeMultipart(key, uploadID string, parts []types.CompletedPart) error {
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	_, err := b.S3().CompleteMultipartUpload(abortCtx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &b.Name,
+		Key:             &key,
+		UploadId:        &uploadID,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+// Throw away the parts of an upload, so they are not left behind (and billed)
+func (b *Bucket) abortMultipart(key, uploadID string, why error) {
+	// Clean up even when the proxy is shutting down
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := b.S3().AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   &b.Name,
+		Key:      &key,
+		UploadId: &uploadID,
+	})
+	log.Printf("Aborted multipart upload of %s/%s: %v", b.Name, key, why)
+	if err != nil {
+		log.Println("Error aborting multipart upload:", err)
+	}
+}
+
+// Stream the body of the put into a multipart upload.  Each part is sent with
+// its own checksum, and the checksum of the whole object is worked out on the
+// way through and checked against the one asked for before the upload is
+// completed.  On any failure the upload is aborted so no parts are left
+// behind.  The checksum and the size of the object are returned, a
+// ContentLength of -1 reads the body until it ends.
+func (b *Bucket) multipartUpload(in *s3.PutObjectInput) (string, int64, error) {
+	alg := in.ChecksumAlgorithm
+	if alg == "" {
+		alg = types.ChecksumAlgorithmSha256
+	}
+	want := wantedChecksum(in)
+	key := aws.ToString(in.Key)
+	uploadID, err := b.createMultipart(in, alg)
+	if err != nil {
+		return "", 0, err
+	}
+	abort := func(why error) { b.abortMultipart(key, uploadID, why) }
+
+	// Grow the parts for objects which would need too many of them.  When the
+	// size is not known, every thousand parts are twice the size of the ones
+	// before, the parts of an upload do not have to be the same size.
+	partSize := partSizeFor(in.ContentLength)
+	sizeOf := func(n int32) int64 {
+		if in.ContentLength >= 0 {
+			return partSize
+		}
+		size := partSize << ((n - 1) / 1000)
+		if size > multipartMaxPart || size <= 0 {
+			return multipartMaxPart
+		}
+		return size
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mutex    sync.Mutex
+		parts    []types.CompletedPart
+		firstErr error
+		read     int64
+	)
+	failed := func() error {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return firstErr
+	}
+	fail := func(err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	// The slots are handed back when a part is done, which limits the parts in
+	// flight of this upload, the buffers come from the pool shared by all
+	slots := make(chan struct{}, multipartConcurrency)
+	full := newChecksumHash(alg)
+	for n := int32(1); failed() == nil; n++ {
+		if n > multipartMaxParts {
+			fail(fmt.Errorf("more than %d parts, use a larger MULTIPART_PART_SIZE", multipartMaxParts))
+			break
+		}
+		slots <- struct{}{}
+		buf := partBuffers.get(sizeOf(n))
+		m, rerr := io.ReadFull(in.Body, buf)
+		read += int64(m)
+		if m == 0 {
+			partBuffers.put(buf)
+			<-slots
+			if rerr != io.EOF {
+				fail(rerr)
+			}
+			break
+		}
+		chunk := buf[:m]
+		full.Write(chunk)
+
+		wg.Add(1)
+		go func(n int32, chunk []byte) {
+			defer wg.Done()
+			defer func() { partBuffers.put(chunk); <-slots }()
+			part, err := b.uploadPart(key, uploadID, n, chunk, alg)
+			if err != nil {
+				fail(err)
+				return
+			}
+			mutex.Lock()
+			parts = append(parts, part)
+			mutex.Unlock()
+		}(n, chunk)
+
+		if rerr == io.ErrUnexpectedEOF {
+			// The last part was short
+			break
+		} else if rerr != nil {
+			fail(rerr)
+		}
+	}
+	wg.Wait()
+
+	if err := failed(); err != nil {
+		abort(err)
+		return "", 0, err
+	}
+	if in.ContentLength >= 0 && read != in.ContentLength {
+		err := fmt.Errorf("body ended after %d of %d bytes", read, in.ContentLength)
+		abort(err)
+		return "", 0, err
+	}
+	sum := full.Sum(nil)
+	checksum := fmt.Sprintf("{%s}%02x", checksumName(alg), sum)
+	if want != "" && want != base64.StdEncoding.EncodeToString(sum) {
+		err := fmt.Errorf("%w: the upload has %s", errChecksumMismatch, checksum)
+		abort(err)
+		return "", 0, err
+	}
+
+	if err := b.completeMultipart(key, uploadID, parts); err != nil {
+		abort(err)
+		return "", 0, err
+	}
+	if debug {
+		log.Printf("Multipart upload of %s/%s done in %d parts, %s", b.Name, key, len(parts), checksum)
+	}
+	if want == "" {
+		if err := b.tagChecksum(key, checksum); err != nil {
+			// The object is stored, only its listing will lack the checksum
+			log.Printf("Error tagging the checksum of %s/%s: %v", b.Name, key, err)
+		}
+	}
+	return checksum, read, nil
+}
+
+// Keep the checksum worked out on the way through in the tags of an object
+// uploaded in parts.  The metadata could only be changed by copying the object
+// onto itself, the tags can be set as they are.  A tag value can't hold the
+// braces, so the checksum is kept like "SHA256:<hex>".
+func (b *Bucket) tagChecksum(key, checksum string) error {
+	alg, sum, _ := strings.Cut(strings.TrimPrefix(checksum, "{"), "}")
+	_, err := b.S3().PutObjectTagging(abortCtx, &s3.PutObjectTaggingInput{
+		Bucket: &b.Name,
+		Key:    &key,
+		Tagging: &types.Tagging{TagSet: []types.Tag{
+			{Key: aws.String("checksum"), Value: aws.String(alg + ":" + sum)},
+		}},
+	})
+	return err
+}
+
+// The checksum of the object for its listing and the ETag of a download.  The
+// tags are only looked up for an object uploaded in parts, which has an ETag
+// like "<md5>-12", without the checksum in its metadata.
+func (b *Bucket) objectChecksum(key string, obj interface{}) string {
+	var etag string
+	switch t := obj.(type) {
+	case *s3.HeadObjectOutput:
+		etag = aws.ToString(t.ETag)
+	case *s3.GetObjectOutput:
+		etag = aws.ToString(t.ETag)
+	}
+	if _, ok := checksumMetadata(obj); !ok && strings.Contains(etag, "-") {
+		out, err := b.S3().GetObjectTagging(abortCtx, &s3.GetObjectTaggingInput{
+			Bucket: &b.Name,
+			Key:    &key,
+		})
+		if err != nil {
+			log.Printf("Error reading the tags of %s/%s: %v", b.Name, key, err)
+		} else {
+			for _, tag := range out.TagSet {
+				if alg, sum, ok := strings.Cut(aws.ToString(tag.Value), ":"); ok && aws.ToString(tag.Key) == "checksum" {
+					return "{" + alg + "}" + sum
+				}
+			}
+		}
+	}
+	return encodeChecksum(obj)
+}
+
+// The buffers of the parts in flight, shared by all uploads so together they
+// take at most MULTIPART_CONCURRENCY parts of MULTIPART_PART_SIZE of memory.
+// The buffers handed back are kept for the next part until none are in use.
+type partPool struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	size  int64 // The memory of the buffers, in use or free
+	inUse int
+	free  [][]byte
+}
+
+var partBuffers = newPartPool()
+
+func newPartPool() *partPool {
+	p := &partPool{}
+	p.cond = sync.NewCond(&p.mutex)
+	return p
+}
+
+// Wait for a buffer of the size, a part larger than the pool has it to itself
+func (p *partPool) get(size int64) []byte {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for {
+		for i, buf := range p.free {
+			if int64(cap(buf)) >= size {
+				p.free = append(p.free[:i], p.free[i+1:]...)
+				p.inUse++
+				return buf[:size]
+			}
+		}
+		if p.size+size <= int64(multipartConcurrency)*multipartPartSize || p.size == 0 {
+			p.size += size
+			p.inUse++
+			return make([]byte, size)
+		}
+		if len(p.free) > 0 {
+			// Too small for the part, make room for one which is not
+			p.size -= int64(cap(p.free[0]))
+			p.free = p.free[1:]
+			continue
+		}
+		p.cond.Wait()
+	}
+}
+
+func (p *partPool) put(buf []byte) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.inUse--
+	if p.inUse == 0 {
+		// Nothing is uploading, hand the memory back
+		p.free, p.size = nil, 0
+	} else {
+		p.free = append(p.free, buf[:cap(buf)])
+	}
+	p.cond.Broadcast()
+}
+
+// The part size for an object of the size, grown when the object would need
+// more parts than S3 allows
+func partSizeFor(size int64) int64 {
+	partSize := multipartPartSize
+	for size > 0 && (size+partSize-1)/partSize > multipartMaxParts {
+		partSize *= 2
+	}
+	return partSize
+}
+
+// Upload a body of unknown length, like a chunked upload from a pipe.  A body
+// which fits in one part is sent as a single put, anything larger as a
+// multipart upload.  The buffer for the first part grows as the body comes in,
+// so a small file does not take a whole part of memory.  The checksum and the
+// size of the object are returned.
+func (b *Bucket) streamUpload(in *s3.PutObjectInput) (string, int64, error) {
+	var first bytes.Buffer
+	n, err := io.CopyN(&first, in.Body, multipartPartSize)
+	switch err {
+	case nil:
+		// There is more to come
+		in.Body = io.MultiReader(&first, in.Body)
+		in.ContentLength = -1
+		return b.multipartUpload(in)
+	case io.EOF:
+		in.Body, in.ContentLength = bytes.NewReader(first.Bytes()), n
+		out, err := b.S3().PutObject(abortCtx, in)
+		if err != nil {
+			return "", 0, err
+		}
+		return encodeChecksum(out), n, nil
+	}
+	return "", 0, err
+}
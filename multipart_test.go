@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Just enough of S3 in memory for the uploads of the proxy
+type fakeObject struct {
+	data []byte
+	meta map[string]string
+	tags []byte // The Tagging XML as sent
+}
+
+type fakeS3 struct {
+	mutex   sync.Mutex
+	objects map[string]*fakeObject
+	uploads map[string]*fakeObject
+	parts   map[string]map[int][]byte
+	calls   []string
+}
+
+// A bucket served by a fake S3 for the length of the test
+func newFakeS3(t *testing.T) (*Bucket, *fakeS3) {
+	t.Helper()
+	f := &fakeS3{objects: map[string]*fakeObject{}, uploads: map[string]*fakeObject{}, parts: map[string]map[int][]byte{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	savedEndpoint, savedPathStyle := s3Endpoint, s3PathStyle
+	s3Endpoint, s3PathStyle = srv.URL, true
+	t.Cleanup(func() { s3Endpoint, s3PathStyle = savedEndpoint, savedPathStyle })
+
+	if mimeTypes.Load() == nil {
+		mimeTypes.Store(&map[string]string{})
+	}
+	b := &Bucket{Name: "test", Path: "/"}
+	b.client.Store(newS3Client(aws.Config{
+		Region:      "us-east-1",
+		Credentials: credentials.NewStaticCredentialsProvider("x", "y", ""),
+	}))
+	return b, f
+}
+
+func (f *fakeS3) object(key string) *fakeObject {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.objects[key]
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/test/")
+	q := r.URL.Query()
+	meta := map[string]string{}
+	for k, v := range r.Header {
+		if strings.HasPrefix(strings.ToLower(k), "x-amz-meta-") {
+			meta[strings.ToLower(k[len("x-amz-meta-"):])] = v[0]
+		}
+	}
+	body, _ := io.ReadAll(r.Body)
+	sum := fmt.Sprintf(`"%x"`, sha256.Sum256(body))
+
+	switch {
+	case r.Method == "PUT" && r.Header.Get("X-Amz-Copy-Source") != "":
+		f.calls = append(f.calls, "copy "+key)
+		src := f.objects[strings.TrimPrefix(r.Header.Get("X-Amz-Copy-Source"), "test/")]
+		if src == nil {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("X-Amz-Metadata-Directive") != "REPLACE" {
+			meta = src.meta
+		}
+		f.objects[key] = &fakeObject{data: src.data, meta: meta}
+		fmt.Fprintf(w, `<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>`, sum)
+	case r.Method == "PUT" && q.Has("partNumber"):
+		f.calls = append(f.calls, "part "+key)
+		var n int
+		fmt.Sscan(q.Get("partNumber"), &n)
+		f.parts[q.Get("uploadId")][n] = body
+		w.Header().Set("ETag", sum)
+	case r.Method == "PUT" && q.Has("tagging"):
+		f.calls = append(f.calls, "tag "+key)
+		if f.objects[key] == nil {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		f.objects[key].tags = body
+	case r.Method == "GET" && q.Has("tagging"):
+		if f.objects[key] == nil || f.objects[key].tags == nil {
+			fmt.Fprint(w, `<Tagging><TagSet></TagSet></Tagging>`)
+			return
+		}
+		w.Write(f.objects[key].tags)
+	case r.Method == "PUT":
+		f.calls = append(f.calls, "put "+key)
+		f.objects[key] = &fakeObject{data: body, meta: meta}
+		w.Header().Set("ETag", sum)
+	case r.Method == "POST" && q.Has("uploads"):
+		f.calls = append(f.calls, "create "+key)
+		id := fmt.Sprint(len(f.uploads) + 1)
+		f.uploads[id], f.parts[id] = &fakeObject{meta: meta}, map[int][]byte{}
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, key, id)
+	case r.Method == "POST" && q.Has("uploadId"):
+		f.calls = append(f.calls, "complete "+key)
+		id := q.Get("uploadId")
+		var nums []int
+		for n := range f.parts[id] {
+			nums = append(nums, n)
+		}
+		sort.Ints(nums)
+		var data []byte
+		for _, n := range nums {
+			data = append(data, f.parts[id][n]...)
+		}
+		f.objects[key] = &fakeObject{data: data, meta: f.uploads[id].meta}
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Key>%s</Key><ETag>"%d-parts"</ETag></CompleteMultipartUploadResult>`, key, len(nums))
+	case r.Method == "DELETE" && q.Has("uploadId"):
+		f.calls = append(f.calls, "abort "+key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "<Error><Code>NotImplemented</Code></Error>", http.StatusNotImplemented)
+	}
+}
+
+func TestMultipartChecksumMetadata(t *testing.T) {
+	b, f := newFakeS3(t)
+	saved := multipartPartSize
+	multipartPartSize = 1000
+	defer func() { multipartPartSize = saved }()
+
+	data := bytes.Repeat([]byte("0123456789"), 250)
+	want := fmt.Sprintf("{SHA256}%x", sha256.Sum256(data))
+
+	// Without a checksum from the client the one worked out is recorded
+	in, _ := b.putInput("plain.bin", "", nil, nil)
+	in.Body = bytes.NewReader(data)
+	checksum, size, err := b.streamUpload(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checksum != want || size != int64(len(data)) {
+		t.Errorf("got %s of %d bytes", checksum, size)
+	}
+	obj := f.object("plain.bin")
+	if obj == nil || !bytes.Equal(obj.data, data) {
+		t.Fatal("the object was not stored")
+	}
+	// The object is not copied onto itself to change its metadata, the
+	// checksum is kept in a tag which is read for an ETag of many parts
+	if strings.Join(f.calls, ",") != "create plain.bin,part plain.bin,part plain.bin,part plain.bin,complete plain.bin,tag plain.bin" {
+		t.Errorf("unexpected calls %v", f.calls)
+	}
+	if got := b.objectChecksum("plain.bin", &s3.HeadObjectOutput{ETag: aws.String(`"abc-3"`)}); got != want {
+		t.Errorf("expected the checksum %s from the tags, got %s", want, got)
+	}
+
+	// With one it is kept in the metadata from the start
+	f.calls = nil
+	in, _ = b.putInput("summed.bin", "", []byte("2023-01-02 03:04:05"), []byte(want))
+	in.Body = bytes.NewReader(data)
+	if _, _, err := b.streamUpload(in); err != nil {
+		t.Fatal(err)
+	}
+	obj = f.object("summed.bin")
+	if got := b.objectChecksum("summed.bin", &s3.HeadObjectOutput{ETag: aws.String(`"abc-3"`), Metadata: obj.meta}); got != want {
+		t.Errorf("expected the checksum %s from the metadata, got %s", want, got)
+	}
+	if obj.meta["checksum"] != want || obj.meta["date"] != "2023-01-02 03:04:05" {
+		t.Errorf("unexpected metadata %v", obj.meta)
+	}
+	for _, call := range f.calls {
+		if strings.HasPrefix(call, "copy") || strings.HasPrefix(call, "tag") {
+			t.Errorf("unexpected calls %v", f.calls)
+		}
+	}
+}
+
+func TestStreamUploadSmallBody(t *testing.T) {
+	b, f := newFakeS3(t)
+	if multipartPartSize < 64<<20 {
+		t.Skip("expects the default part size")
+	}
+
+	// A small body takes about its own size of memory, not a whole part
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	in, _ := b.putInput("small.txt", "", nil, nil)
+	in.Body = strings.NewReader("hello world")
+	checksum, size, err := b.streamUpload(in)
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grown := after.TotalAlloc - before.TotalAlloc; grown > 8<<20 {
+		t.Errorf("a small upload allocated %d bytes", grown)
+	}
+	if size != 11 || checksum == "" || string(f.object("small.txt").data) != "hello world" {
+		t.Errorf("got %s of %d bytes", checksum, size)
+	}
+	if strings.Join(f.calls, ",") != "put small.txt" {
+		t.Errorf("unexpected calls %v", f.calls)
+	}
+}
+
+func TestPartPoolShared(t *testing.T) {
+	savedSize, savedConcurrency := multipartPartSize, multipartConcurrency
+	multipartPartSize, multipartConcurrency = 1000, 2
+	defer func() { multipartPartSize, multipartConcurrency = savedSize, savedConcurrency }()
+	p := newPartPool()
+
+	// Two parts fill the pool, whichever upload they are from
+	a, b := p.get(1000), p.get(1000)
+	got := make(chan []byte)
+	go func() { got <- p.get(1000) }()
+	select {
+	case <-got:
+		t.Fatal("a third part got a buffer from a full pool")
+	case <-time.After(50 * time.Millisecond):
+	}
+	p.put(a)
+	if c := <-got; &c[0] != &a[0] {
+		t.Error("the buffer handed back was not used again")
+	} else {
+		p.put(c)
+	}
+
+	// A larger part waits for room, the free buffer is dropped for it
+	go func() { got <- p.get(1500) }()
+	select {
+	case <-got:
+		t.Fatal("a larger part got a buffer from a full pool")
+	case <-time.After(50 * time.Millisecond):
+	}
+	p.put(b)
+	if c := <-got; len(c) != 1500 || p.size != 1500 {
+		t.Errorf("got %d bytes with %d in the pool", len(c), p.size)
+	} else {
+		p.put(c)
+	}
+	if p.inUse != 0 || p.size != 0 || len(p.free) != 0 {
+		t.Errorf("memory kept after the uploads: %+v", p)
+	}
+}
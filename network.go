@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// A list of address ranges, parsed from CIDRs or single addresses
+type prefixList []netip.Prefix
+
+func parsePrefixes(list []string) (prefixList, error) {
+	var prefixes prefixList
+	for _, v := range list {
+		if strings.Contains(v, "/") {
+			p, err := netip.ParsePrefix(v)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		a, err := netip.ParseAddr(v)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(a, a.BitLen()))
+	}
+	return prefixes, nil
+}
+
+func (l prefixList) contains(a netip.Addr) bool {
+	a = a.Unmap()
+	for _, p := range l {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkPrefixes(v string) error {
+	_, err := parsePrefixes(strings.FieldsFunc(v, splitList))
+	return err
+}
+
+// Split lists on commas as well as spaces
+func splitList(r rune) bool {
+	return r == ',' || r == ' ' || r == '\t' || r == '\n'
+}
+
+// The address of the client making the request.  When the connection comes
+// from a trusted proxy, the X-Forwarded-For header is followed back to the
+// first address which is not a trusted proxy.
+func clientIP(ctx *fasthttp.RequestCtx) netip.Addr {
+	if a, ok := ctx.UserValue("clientIP").(netip.Addr); ok {
+		return a
+	}
+	a, _ := netip.AddrFromSlice(ctx.RemoteIP())
+	a = a.Unmap()
+	if trusted := live.Load().trustedProxies; trusted.contains(a) {
+		var hops []string
+		ctx.Request.Header.VisitAll(func(k, v []byte) {
+			if strings.EqualFold(b2s(k), "X-Forwarded-For") {
+				hops = append(hops, strings.Split(string(v), ",")...)
+			}
+		})
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				if ap, err2 := netip.ParseAddrPort(strings.TrimSpace(hops[i])); err2 == nil {
+					hop, err = ap.Addr(), nil
+				}
+			}
+			if err != nil {
+				// A garbled entry can't be followed any further
+				break
+			}
+			a = hop.Unmap()
+			if !trusted.contains(a) {
+				break
+			}
+		}
+	}
+	ctx.SetUserValue("clientIP", a)
+	return a
+}
+
+// A network rule from the ACL file.  When the path and verb match, the client
+// address must not be in the deny list and, if there is an allow list, must
+// be in it.  Like an access rule, a host limits the rule to requests for it.
+type networkRule struct {
+	Name  string   `yaml:"name"`
+	Host  string   `yaml:"host"`
+	Path  string   `yaml:"path"`
+	Verbs []string `yaml:"verbs"`
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+
+	re          *regexp.Regexp
+	allow, deny prefixList
+}
+
+// The network rules, every rule which matches a request has to let it through.
+type networkRules []*networkRule
+
+func (n networkRules) check(file string) (err error) {
+	for i, r := range n {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("network %d", i+1)
+		}
+		if !strings.HasPrefix(r.Path, "/") {
+			return fmt.Errorf("%s: %s: path %q must start with /", file, r.Name, r.Path)
+		}
+		if strings.Contains(r.Host, "/") {
+			return fmt.Errorf("%s: %s: host %q is not a host name", file, r.Name, r.Host)
+		}
+		if len(r.Verbs) == 0 {
+			return fmt.Errorf("%s: %s: no verbs given", file, r.Name)
+		}
+		for _, v := range r.Verbs {
+			if v != "*" && !contains(aclVerbs, v) {
+				return fmt.Errorf("%s: %s: unknown verb %q, expected one of %s or *", file, r.Name, v, strings.Join(aclVerbs, ", "))
+			}
+		}
+		if len(r.Allow) == 0 && len(r.Deny) == 0 {
+			return fmt.Errorf("%s: %s: no allow or deny ranges given", file, r.Name)
+		}
+		if r.allow, err = parsePrefixes(r.Allow); err != nil {
+			return fmt.Errorf("%s: %s: %w", file, r.Name, err)
+		}
+		if r.deny, err = parsePrefixes(r.Deny); err != nil {
+			return fmt.Errorf("%s: %s: %w", file, r.Name, err)
+		}
+		r.re = globRegexp(r.Path)
+	}
+	return nil
+}
+
+// Is the verb on the path of the host allowed from the address?  The reason
+// names the rule which refused it.
+func (n networkRules) allowed(a netip.Addr, host, verb, p string) (bool, string) {
+	for _, r := range n {
+		if !(contains(r.Verbs, verb) || contains(r.Verbs, "*")) || !hostMatch(r.Host, host) || !r.re.MatchString(p) {
+			continue
+		}
+		if r.deny.contains(a) || (len(r.allow) > 0 && !r.allow.contains(a)) {
+			return false, fmt.Sprintf("%s on %s not allowed from %s by %q", verb, p, a, r.Name)
+		}
+	}
+	return true, ""
+}
+
+// A listener which reads the PROXY protocol header (version 1 or 2) sent by
+// a load balancer, so the address of the client is seen instead of the load
+// balancer.  The header is required from the trusted proxies and not read from
+// anyone else, who could otherwise claim any address.
+type proxyListener struct {
+	net.Listener
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tcp, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return c, nil
+	}
+	a, _ := netip.AddrFromSlice(tcp.IP)
+	if !live.Load().trustedProxies.contains(a) {
+		return c, nil
+	}
+	return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// How long a connection has to send the PROXY header
+var proxyHeaderTimeout = 5 * time.Second
+
+// A connection starting with a PROXY header, which is read on first use so a
+// slow client does not hold up the accept loop.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	mutex  sync.Mutex
+	done   bool
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) init() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.done {
+		return c.err
+	}
+	c.done = true
+	c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	c.remote, c.err = readProxyHeader(c.r)
+	c.Conn.SetReadDeadline(time.Time{})
+	if c.err != nil {
+		log.Printf("Dropping connection from %s: PROXY header: %v", c.Conn.RemoteAddr(), c.err)
+		c.Conn.Close()
+	}
+	return c.err
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if err := c.init(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.init() == nil && c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Read the PROXY header, returning the source address it carries or nil when
+// the connection is from the load balancer itself.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(sig, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	if !bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return nil, errors.New("missing")
+	}
+
+	// Version 1 is a single line of at most 107 bytes
+	var line []byte
+	for len(line) < 107 {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("version 1 line too long")
+	}
+	f := strings.Fields(string(line[:len(line)-2]))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid version 1 line %q", line)
+	}
+	src, err := netip.ParseAddrPort(net.JoinHostPort(f[2], f[4]))
+	if err != nil {
+		return nil, err
+	}
+	return net.TCPAddrFromAddrPort(src), nil
+}
+
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported version %d", hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if hdr[12]&0xf == 0 {
+		// A LOCAL command, like a health check from the load balancer
+		return nil, nil
+	}
+	var src netip.Addr
+	var port []byte
+	switch hdr[13] >> 4 {
+	case 1: // IPv4
+		if len(body) < 12 {
+			return nil, errors.New("short IPv4 address block")
+		}
+		src, port = netip.AddrFrom4([4]byte(body[:4])), body[8:10]
+	case 2: // IPv6
+		if len(body) < 36 {
+			return nil, errors.New("short IPv6 address block")
+		}
+		src, port = netip.AddrFrom16([16]byte(body[:16])), body[32:34]
+	default:
+		return nil, nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(port))), nil
+}
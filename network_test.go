@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNetworkRuleHosts(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "acl.yaml")
+	os.WriteFile(file, []byte(`
+networks:
+  - name: internal-host
+    host: internal.example.com
+    path: /**
+    verbs: ["*"]
+    allow: [10.0.0.0/8]
+  - name: no-guests
+    path: /uploads/
+    verbs: [upload]
+    deny: [10.99.0.0/16]
+`), 0600)
+	a, err := loadACL(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inside, outside, guest := netip.MustParseAddr("10.1.2.3"), netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("10.99.0.1")
+	tests := []struct {
+		a             netip.Addr
+		host, verb, p string
+		ok            bool
+	}{
+		{inside, "internal.example.com", "read", "/x", true},
+		{outside, "internal.example.com", "read", "/x", false},
+		{outside, "Internal.Example.com", "read", "/x", false},
+		{outside, "public.example.com", "read", "/x", true},
+		{guest, "public.example.com", "upload", "/uploads/x", false},
+		{guest, "public.example.com", "read", "/uploads/x", true},
+	}
+	for _, tt := range tests {
+		if ok, why := a.Networks.allowed(tt.a, tt.host, tt.verb, tt.p); ok != tt.ok {
+			t.Errorf("%s %s %s%s: got %v (%s)", tt.a, tt.verb, tt.host, tt.p, ok, why)
+		}
+	}
+}
+
+func TestProxyProtocolTrusted(t *testing.T) {
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	pl := proxyListener{ln}
+	saved := live.Load()
+	defer live.Store(saved)
+
+	// The remote address and first line seen for a connection sending a header
+	accept := func() (string, string) {
+		c, err := net.Dial("tcp4", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.Write([]byte("PROXY TCP4 192.0.2.7 127.0.0.1 4000 80\r\nGET / HTTP/1.1\r\n"))
+		s, err := pl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		line, _ := bufio.NewReader(s).ReadString('\n')
+		host, _, _ := net.SplitHostPort(s.RemoteAddr().String())
+		return host, line
+	}
+
+	// Anyone else could claim any address with the header
+	proxies, _ := parsePrefixes([]string{"10.0.0.0/8"})
+	live.Store(&liveSettings{trustedProxies: proxies})
+	if host, line := accept(); host != "127.0.0.1" || !strings.HasPrefix(line, "PROXY ") {
+		t.Errorf("the header of an untrusted peer was read, got %s and %q", host, line)
+	}
+	live.Store(&liveSettings{})
+	if host, _ := accept(); host != "127.0.0.1" {
+		t.Errorf("the header was read without trusted proxies, got %s", host)
+	}
+
+	proxies, _ = parsePrefixes([]string{"127.0.0.1"})
+	live.Store(&liveSettings{trustedProxies: proxies})
+	if host, line := accept(); host != "192.0.2.7" || line != "GET / HTTP/1.1\r\n" {
+		t.Errorf("the header of a trusted proxy was not read, got %s and %q", host, line)
+	}
+}
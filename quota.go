@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"gopkg.in/yaml.v3"
+)
+
+// A quota from the quota file, a ceiling on the bytes and objects stored under
+// a path.  A "{user}" segment in the path gives every user a quota of their
+// own, and the users and groups limit who the quota applies to.
+type quotaRule struct {
+	Name    string   `yaml:"name"`
+	Path    string   `yaml:"path"`
+	Users   []string `yaml:"users"`
+	Groups  []string `yaml:"groups"`
+	Bytes   string   `yaml:"bytes"`
+	Objects int64    `yaml:"objects"`
+
+	maxBytes int64
+}
+
+// The quotas, an upload must fit in every quota which applies to it.
+type quotas struct {
+	File   string       `yaml:"-"`
+	Quotas []*quotaRule `yaml:"quotas"`
+}
+
+// Read and validate the quota file
+func loadQuotas(file string) (*quotas, error) {
+	dat, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	q := &quotas{File: file}
+	dec := yaml.NewDecoder(bytes.NewReader(dat))
+	dec.KnownFields(true)
+	if err := dec.Decode(q); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	for i, r := range q.Quotas {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("quota %d", i+1)
+		}
+		if !strings.HasPrefix(r.Path, "/") || !strings.HasSuffix(r.Path, "/") {
+			return nil, fmt.Errorf("%s: %s: path %q must start and end with /", file, r.Name, r.Path)
+		}
+		if n := strings.Count(r.Path, "{user}"); n > 1 || (n == 1 && !strings.Contains(r.Path, "/{user}/")) {
+			return nil, fmt.Errorf("%s: %s: {user} may only be used once, as a whole path segment", file, r.Name)
+		}
+		if r.Bytes != "" {
+			if r.maxBytes, err = parseSize(r.Bytes); err != nil {
+				return nil, fmt.Errorf("%s: %s: bytes %q: %w", file, r.Name, r.Bytes, err)
+			}
+		}
+		if r.maxBytes <= 0 && r.Objects <= 0 {
+			return nil, fmt.Errorf("%s: %s: no bytes or objects limit given", file, r.Name)
+		}
+	}
+	return q, nil
+}
+
+// The path of the quota for the caller, empty when it does not apply.  A
+// caller whose user name can't be a folder, like no user or one with a slash,
+// gets no folder of their own and no room in the folder above it either.
+func (r *quotaRule) pathFor(id *Identity) (p string, full bool) {
+	if !memberOf(id, r.Users, r.Groups) {
+		return "", false
+	}
+	if !strings.Contains(r.Path, "{user}") {
+		return r.Path, false
+	}
+	if id == nil || id.User == "" || id.User == "." || id.User == ".." || strings.Contains(id.User, "/") {
+		base, _, _ := strings.Cut(r.Path, "{user}/")
+		return base, true
+	}
+	return strings.Replace(r.Path, "{user}", id.User, 1), false
+}
+
+// The prefix of the path within the bucket, empty when the path covers the
+// whole bucket.
+func (b *Bucket) quotaPrefix(p string) string {
+	if len(p) <= len(b.Path) {
+		return ""
+	}
+	return p[len(b.Path):]
+}
+
+type recentUpload struct {
+	time    time.Time
+	uri     string
+	size    int64 // The change in bytes, negative for a removal
+	objects int64
+}
+
+// Remember the change to an object until the index has been listed again.
+func (b *Bucket) recordChange(uri string, size, objects int64) {
+	b.recentMutex.Lock()
+	defer b.recentMutex.Unlock()
+	b.pruneRecent()
+	// The uri may point into the request buffer, which is reused
+	b.recent = append(b.recent, recentUpload{time: time.Now(), uri: strings.Clone(uri), size: size, objects: objects})
+}
+
+// Remember an object of size bytes written in place of the current one
+func (b *Bucket) recordPut(uri string, size int64) {
+	if old, exists := b.objectSize(uri); exists {
+		b.recordChange(uri, size-old, 0)
+	} else {
+		b.recordChange(uri, size, 1)
+	}
+}
+
+// Remember an object which was removed
+func (b *Bucket) recordRemove(uri string) {
+	if old, exists := b.objectSize(uri); exists {
+		b.recordChange(uri, -old, -1)
+	}
+}
+
+// Drop the uploads which the index already has.  Uploads which finished while
+// the index was being listed are kept and may be counted twice for a short
+// while, erring on the side of refusing.
+func (b *Bucket) pruneRecent() {
+	i := 0
+	for i < len(b.recent) && b.recent[i].time.Before(b.dirListed) {
+		i++
+	}
+	b.recent = b.recent[i:]
+}
+
+// The bytes and objects stored under the prefix of the bucket, from the index
+// and the uploads made since it was listed.
+func (b *Bucket) usage(prefix string) (size, objects int64) {
+	if prefix == "" {
+		size, objects = b.dir.size, b.dir.count
+	} else if d, ok := b.dir.objects[prefix]; ok && d.isDir {
+		size, objects = d.Size, d.Count
+	}
+	b.recentMutex.Lock()
+	defer b.recentMutex.Unlock()
+	b.pruneRecent()
+	for _, r := range b.recent {
+		if strings.HasPrefix(r.uri, prefix) {
+			size += r.size
+			objects += r.objects
+		}
+	}
+	return
+}
+
+// The size of an object and whether it is there, from the index and the
+// changes made since it was listed.
+func (b *Bucket) objectSize(uri string) (size int64, exists bool) {
+	var objects int64
+	if d, ok := b.dir.objects[uri]; ok && !d.isDir {
+		size, objects = d.Size, 1
+	}
+	b.recentMutex.Lock()
+	defer b.recentMutex.Unlock()
+	b.pruneRecent()
+	for _, r := range b.recent {
+		if r.uri == uri {
+			size += r.size
+			objects += r.objects
+		}
+	}
+	return size, objects > 0
+}
+
+// Check that adding size bytes as the object fits in the quotas of the caller,
+// answering with a 507 when it does not.  The size of an object which is
+// replaced is taken off.
+func (q *quotas) allow(ctx *fasthttp.RequestCtx, b *Bucket, uri string, id *Identity, size int64) bool {
+	if status, msg := q.check(b, uri, id, size); status != 0 {
+		ctx.Error(msg, status)
+		return false
+	}
+	return true
+}
+
+// The status and message when adding the object goes over a quota, a status
+// of 0 when it fits.
+func (q *quotas) check(b *Bucket, uri string, id *Identity, size int64) (int, string) {
+	if q == nil {
+		return 0, ""
+	}
+	if time.Now().Sub(b.dirUpdate) > bucketTimeout {
+		b.buildDirList()
+	}
+	if b.dirError != nil {
+		return fasthttp.StatusServiceUnavailable, "503 quota usage is unknown, the bucket could not be listed"
+	}
+	oldSize, exists := b.objectSize(uri)
+	var newObjects int64
+	if !exists {
+		newObjects = 1
+	}
+	for _, r := range q.Quotas {
+		p, full := r.pathFor(id)
+		if p == "" || !strings.HasPrefix(b.Path+uri, p) {
+			continue
+		}
+		used, objects := b.usage(b.quotaPrefix(p))
+		switch {
+		case full:
+			return fasthttp.StatusInsufficientStorage,
+				fmt.Sprintf("507 insufficient storage: quota %q has no folder under %s for %s", r.Name, p, id)
+		case r.maxBytes > 0 && used-oldSize+size > r.maxBytes:
+			return fasthttp.StatusInsufficientStorage,
+				fmt.Sprintf("507 insufficient storage: quota %q of %s for %s, %d bytes used", r.Name, r.Bytes, p, used)
+		case r.Objects > 0 && objects+newObjects > r.Objects:
+			return fasthttp.StatusInsufficientStorage,
+				fmt.Sprintf("507 insufficient storage: quota %q of %d objects for %s, %d objects stored", r.Name, r.Objects, p, objects)
+		}
+	}
+	return 0, ""
+}
+
+// The bytes which can still be added as the object under the quotas of the
+// caller, false when no byte quota applies.
+func (q *quotas) room(b *Bucket, uri string, id *Identity) (int64, bool) {
+	if q == nil {
+		return 0, false
+	}
+	oldSize, _ := b.objectSize(uri)
+	var room int64
+	var found bool
+	for _, r := range q.Quotas {
+		p, full := r.pathFor(id)
+		if p == "" || !strings.HasPrefix(b.Path+uri, p) || (r.maxBytes <= 0 && !full) {
+			continue
+		}
+		used, _ := b.usage(b.quotaPrefix(p))
+		left := r.maxBytes - used + oldSize
+		if full {
+			left = 0
+		}
+		if !found || left < room {
+			room, found = left, true
+		}
+	}
+	if room < 0 {
+		room = 0
+	}
+	return room, found
+}
+
+var errOverQuota = errors.New("507 insufficient storage: the upload is larger than the room left in its quota")
+
+// Stops a body of unknown length when it goes over the room left in a quota
+type quotaReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	q.left -= int64(n)
+	if q.left < 0 {
+		return n, errOverQuota
+	}
+	return n, err
+}
+
+// The usage of a quota, as shown by the admin /quota endpoint
+type quotaUsage struct {
+	Quota      string
+	Path       string
+	User       string `json:",omitempty"`
+	Bucket     string
+	Bytes      int64
+	Objects    int64
+	MaxBytes   int64 `json:",omitempty"`
+	MaxObjects int64 `json:",omitempty"`
+}
+
+// The usage of every quota in every bucket it covers.  A quota for each user
+// is shown for the users which have stored something under it.
+func (q *quotas) report() []quotaUsage {
+	var list []quotaUsage
+	for _, r := range q.Quotas {
+		base, _, perUser := strings.Cut(r.Path, "{user}/")
+		for _, b := range buckets {
+			if !strings.HasPrefix(base, b.Path) && !strings.HasPrefix(b.Path, base) {
+				continue
+			}
+			if time.Now().Sub(b.dirUpdate) > bucketTimeout {
+				b.buildDirList()
+			}
+			u := quotaUsage{Quota: r.Name, Path: r.Path, Bucket: b.Name, MaxBytes: r.maxBytes, MaxObjects: r.Objects}
+			if !perUser {
+				u.Bytes, u.Objects = b.usage(b.quotaPrefix(r.Path))
+				list = append(list, u)
+				continue
+			}
+			if len(base) < len(b.Path) {
+				// The user folders are above the mount point of this bucket
+				continue
+			}
+			if d, ok := b.dir.objects[b.quotaPrefix(base)]; ok {
+				for _, c := range d.list {
+					if c.isDir {
+						u.User = strings.TrimSuffix(c.Name, "/")
+						u.Path = base + c.Name
+						u.Bytes, u.Objects = b.usage(b.quotaPrefix(u.Path))
+						list = append(list, u)
+					}
+				}
+			}
+		}
+	}
+	return list
+}
+
+// Serve the quota usage as JSON
+func quotaReport(ctx *fasthttp.RequestCtx) {
+	q := live.Load().quotas
+	if q == nil {
+		ctx.Error("404 no quotas are configured", fasthttp.StatusNotFound)
+		return
+	}
+	ctx.SetContentType("application/json")
+	enc := json.NewEncoder(ctx)
+	enc.SetIndent("", "  ")
+	enc.Encode(q.report())
+}
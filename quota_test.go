@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func testQuotas(t *testing.T) (*quotas, *Bucket) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "quota.yaml")
+	os.WriteFile(file, []byte(`
+quotas:
+  - name: home
+    path: /home/{user}/
+    bytes: "1000"
+  - name: pub
+    path: /pub/
+    objects: 3
+`), 0600)
+	q, err := loadQuotas(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Bucket{Name: "test", Path: "/", dirUpdate: time.Now()}
+	b.dir = Root{size: 930, count: 5, objects: map[string]*DirItem{
+		"home/":            {isDir: true, Size: 900, Count: 2},
+		"home/alice/":      {isDir: true, Size: 900, Count: 2},
+		"home/alice/a.bin": {Size: 500},
+		"home/alice/b.bin": {Size: 400},
+		"pub/":             {isDir: true, Size: 30, Count: 3},
+		"pub/one":          {Size: 10},
+	}}
+	return q, b
+}
+
+func TestQuotaCheck(t *testing.T) {
+	q, b := testQuotas(t)
+	alice, bob, slashed := &Identity{User: "alice"}, &Identity{User: "bob"}, &Identity{User: "idp|team/carol"}
+	tests := []struct {
+		id   *Identity
+		uri  string
+		size int64
+		ok   bool
+	}{
+		{alice, "home/alice/c.bin", 100, true},
+		{alice, "home/alice/c.bin", 101, false},
+		{alice, "home/alice/a.bin", 600, true}, // Only the difference counts
+		{alice, "home/alice/a.bin", 601, false},
+		{bob, "home/bob/c.bin", 1000, true},
+		{bob, "home/bob/c.bin", 1001, false},
+		{slashed, "home/idp|team/carol/c.bin", 1, false},
+		{slashed, "home/c.bin", 1, false},
+		{nil, "home/c.bin", 1, false},
+		{slashed, "other/c.bin", 1 << 30, true},
+		{alice, "pub/two", 1, false},
+		{alice, "pub/one", 20, true}, // Replacing is not another object
+	}
+	for _, tt := range tests {
+		status, msg := q.check(b, tt.uri, tt.id, tt.size)
+		if (status == 0) != tt.ok || (!tt.ok && (status != fasthttp.StatusInsufficientStorage || !strings.HasPrefix(msg, "507 "))) {
+			t.Errorf("%s adding %d bytes as %s: got %d %s", tt.id, tt.size, tt.uri, status, msg)
+		}
+	}
+
+	// Uploads count until the index is listed again
+	b.recordPut("home/alice/c.bin", 100)
+	if status, _ := q.check(b, "home/alice/d.bin", alice, 1); status == 0 {
+		t.Error("the recorded upload was not counted")
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	if q.allow(ctx, b, "pub/two", alice, 1) || ctx.Response.StatusCode() != fasthttp.StatusInsufficientStorage {
+		t.Errorf("expected a 507, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestQuotaRoom(t *testing.T) {
+	q, b := testQuotas(t)
+	tests := []struct {
+		id    *Identity
+		uri   string
+		room  int64
+		found bool
+	}{
+		{&Identity{User: "alice"}, "home/alice/c.bin", 100, true},
+		{&Identity{User: "alice"}, "home/alice/a.bin", 600, true},
+		{&Identity{User: "bob"}, "home/bob/c.bin", 1000, true},
+		{&Identity{User: "a/b"}, "home/a/b/c.bin", 0, true},
+		{nil, "home/c.bin", 0, true},
+		{&Identity{User: "alice"}, "pub/two", 0, false},
+	}
+	for _, tt := range tests {
+		if room, found := q.room(b, tt.uri, tt.id); room != tt.room || found != tt.found {
+			t.Errorf("%s at %s: got %d %v", tt.id, tt.uri, room, found)
+		}
+	}
+}
+
+func TestQuotaReader(t *testing.T) {
+	n, err := io.Copy(io.Discard, &quotaReader{r: strings.NewReader("0123456789"), left: 10})
+	if n != 10 || err != nil {
+		t.Errorf("got %d bytes, %v", n, err)
+	}
+	_, err = io.Copy(io.Discard, &quotaReader{r: strings.NewReader("0123456789"), left: 9})
+	if !errors.Is(err, errOverQuota) {
+		t.Errorf("expected errOverQuota, got %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// The limits which can be set, each from the RATE_ setting of the same name
+var rateLimitNames = []string{"list", "download", "download-bytes", "write", "write-bytes", "auth-failures"}
+
+// A rate like "10/s", "600/m:50" or for bytes "100M/s".  The number after the
+// colon is the burst, which defaults to the count per period.
+type rate struct {
+	spec   string
+	perSec float64
+	burst  float64
+}
+
+func parseRate(v string) (rate, error) {
+	r := rate{spec: v}
+	spec, burst, hasBurst := strings.Cut(v, ":")
+	count, period, ok := strings.Cut(spec, "/")
+	if !ok {
+		return r, fmt.Errorf("expected a rate like 10/s or 100M/m:200M")
+	}
+	n, err := parseSize(count)
+	if err != nil || n <= 0 {
+		return r, fmt.Errorf("invalid count %q", count)
+	}
+	var d time.Duration
+	switch period {
+	case "s":
+		d = time.Second
+	case "m":
+		d = time.Minute
+	case "h":
+		d = time.Hour
+	default:
+		return r, fmt.Errorf("invalid period %q, expected s, m or h", period)
+	}
+	r.perSec, r.burst = float64(n)/d.Seconds(), float64(n)
+	if hasBurst {
+		b, err := parseSize(burst)
+		if err != nil || b <= 0 {
+			return r, fmt.Errorf("invalid burst %q", burst)
+		}
+		r.burst = float64(b)
+	}
+	return r, nil
+}
+
+func checkRate(v string) error {
+	_, err := parseRate(v)
+	return err
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// A token bucket for each client of one rate limit
+type limiter struct {
+	rate    rate
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+func newLimiter(r rate) *limiter {
+	return &limiter{rate: r, buckets: make(map[string]*tokenBucket), swept: time.Now()}
+}
+
+// Take n tokens from each of the buckets of the client, only when all of them
+// have at least the tokens needed.  A request needs one token (or any tokens
+// for a byte limit) to go ahead, and may then leave the buckets in debt so a
+// large transfer delays the next ones.  When refused, the time until the
+// request would be allowed is returned.
+func (l *limiter) take(keys rateKeys, n, need float64) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+
+	if now.Sub(l.swept) > time.Minute {
+		// Forget the clients whose buckets have filled up again
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate.perSec >= l.rate.burst {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+
+	var wait time.Duration
+	for _, key := range keys {
+		b, ok := l.buckets[key]
+		if !ok {
+			b = &tokenBucket{tokens: l.rate.burst, last: now}
+			l.buckets[key] = b
+		}
+		b.tokens = math.Min(l.rate.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate.perSec)
+		b.last = now
+		if b.tokens < need {
+			if w := time.Duration((need - b.tokens) / l.rate.perSec * float64(time.Second)); w > wait {
+				wait = w
+			}
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for _, key := range keys {
+		l.buckets[key].tokens -= n
+	}
+	return true, 0
+}
+
+// The limiters by name, "list", "download" and "write" count requests and the
+// "-bytes" ones count bytes.
+type rateLimits map[string]*limiter
+
+// Build the limiters from the config, keeping the state of the limiters whose
+// rate did not change.
+func newRateLimits(conf *Config, old rateLimits) rateLimits {
+	limits := make(rateLimits)
+	for _, name := range rateLimitNames {
+		spec := conf.Get("RATE_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")))
+		if spec == "" {
+			continue
+		}
+		if l, ok := old[name]; ok && l.rate.spec == spec {
+			limits[name] = l
+			continue
+		}
+		r, _ := parseRate(spec)
+		limits[name] = newLimiter(r)
+	}
+	return limits
+}
+
+// Check the limit for the client, answering with a 429 when it is exceeded.
+func (rl rateLimits) allow(ctx *fasthttp.RequestCtx, name string, client rateKeys, n float64) bool {
+	return rl.check(ctx, name, client, n, math.Min(n, 1))
+}
+
+// Refuse the client with a 429 while it has no tokens left for the limit,
+// without taking any.
+func (rl rateLimits) exhausted(ctx *fasthttp.RequestCtx, name string, client rateKeys) bool {
+	return !rl.check(ctx, name, client, 0, 1)
+}
+
+func (rl rateLimits) check(ctx *fasthttp.RequestCtx, name string, client rateKeys, n, need float64) bool {
+	l, ok := rl[name]
+	if !ok {
+		return true
+	}
+	if ok, wait := l.take(client, n, need); !ok {
+		ctx.Error("429 too many requests, rate limit "+name+" "+l.rate.spec, fasthttp.StatusTooManyRequests)
+		ctx.Response.Header.Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		return false
+	}
+	return true
+}
+
+// Take n tokens from the client after the fact, for a transfer whose size was
+// not known up front or for a failed login.
+func (rl rateLimits) charge(name string, client rateKeys, n float64) {
+	if l, ok := rl[name]; ok {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		for _, key := range client {
+			b, ok := l.buckets[key]
+			if !ok {
+				b = &tokenBucket{tokens: l.rate.burst, last: time.Now()}
+				l.buckets[key] = b
+			}
+			b.tokens -= n
+		}
+	}
+}
+
+// The buckets a client is limited by, one per IP address and one for the user
+// when logged in, so neither moving between addresses nor between logins gets
+// around a limit.
+type rateKeys []string
+
+func rateClient(ctx *fasthttp.RequestCtx, id *Identity) rateKeys {
+	keys := rateKeys{"ip:" + clientIP(ctx).String()}
+	if id != nil {
+		keys = append(keys, "user:"+id.User)
+	}
+	return keys
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestRateLimitBothKeys(t *testing.T) {
+	r, _ := parseRate("2/h")
+	limits := rateLimits{"write": newLimiter(r)}
+	allow := func(keys ...string) bool {
+		return limits.allow(&fasthttp.RequestCtx{}, "write", rateKeys(keys), 1)
+	}
+
+	// The user runs out of tokens from two addresses
+	if !allow("ip:10.0.0.1", "user:alice") || !allow("ip:10.0.0.2", "user:alice") {
+		t.Fatal("expected the first two requests to pass")
+	}
+	if allow("ip:10.0.0.3", "user:alice") {
+		t.Error("a new address got the user around the limit")
+	}
+
+	// And an address runs out of tokens with two users
+	if !allow("ip:10.0.0.4", "user:bob") || !allow("ip:10.0.0.4", "user:carol") {
+		t.Fatal("expected the requests of other users to pass")
+	}
+	if allow("ip:10.0.0.4", "user:dave") {
+		t.Error("a new user got the address around the limit")
+	}
+
+	// A refused request takes no tokens from the buckets which had some
+	if !allow("ip:10.0.0.3") || !allow("ip:10.0.0.3") {
+		t.Error("the refused request was charged to its address")
+	}
+}
+
+func TestRateLimitAuthFailures(t *testing.T) {
+	r, _ := parseRate("2/h")
+	limits := rateLimits{"auth-failures": newLimiter(r)}
+	addr := rateKeys{"ip:10.0.0.1"}
+	for i := 0; i < 2; i++ {
+		if limits.exhausted(&fasthttp.RequestCtx{}, "auth-failures", addr) {
+			t.Fatalf("refused after %d failures", i)
+		}
+		limits.charge("auth-failures", addr, 1)
+	}
+	ctx := &fasthttp.RequestCtx{}
+	if !limits.exhausted(ctx, "auth-failures", addr) {
+		t.Fatal("expected the address to be refused after 2 failures")
+	}
+	if ctx.Response.StatusCode() != fasthttp.StatusTooManyRequests || len(ctx.Response.Header.Peek("Retry-After")) == 0 {
+		t.Errorf("unexpected response %d", ctx.Response.StatusCode())
+	}
+	if limits.exhausted(&fasthttp.RequestCtx{}, "auth-failures", rateKeys{"ip:10.0.0.2"}) {
+		t.Error("another address was refused")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// The settings which can be changed while the proxy is running.  They are
+// swapped in as a whole on reload, so a request sees either the old or the new
+// settings and transfers which are already streaming are not interrupted.
+type liveSettings struct {
+	directoryIndex, directoryHeader, directoryFooter []string
+	uploadHeader                                     string
+	forwardedUser, forwardedGroups                   string
+	htpasswd                                         *htpasswd
+	jwt                                              *jwtVerifier
+	acl                                              *acl
+	networks                                         networkRules
+	trustedProxies                                   prefixList
+	quotas                                           *quotas
+	share                                            *shareSigner
+	certUser                                         string
+	authRealm                                        string
+	limits                                           rateLimits
+}
+
+// Is a login method configured?
+func (ls *liveSettings) authEnabled() bool {
+	return ls.htpasswd != nil || ls.jwt != nil
+}
+
+// Settings which are only read at startup, a change in these is logged on
+// reload as needing a restart.
+var restartSettings = []string{"BUCKET_NAME", "BUCKET_PREFIX", "BUCKET_REGION", "BUCKET_ROLE_ARN",
+	"BUCKET_ROLE_EXTERNAL_ID", "BUCKET_ROLE_SESSION_NAME", "S3_ENDPOINT",
+	"S3_PATH_STYLE", "S3_INSECURE_SKIP_VERIFY", "LISTEN", "TLS_CERT_FILE", "TLS_KEY_FILE",
+	"TLS_CLIENT_CA_FILE", "TLS_CLIENT_CERT_REQUIRED", "PROXY_PROTOCOL", "ADMIN_LISTEN", "AUDIT_LOG",
+	"AUDIT_MAX_SIZE", "AUDIT_MAX_AGE", "AUDIT_MIRROR_PATH", "MULTIPART_THRESHOLD",
+	"MULTIPART_PART_SIZE", "MULTIPART_CONCURRENCY", "EXTRACT_MAX_SIZE", "TUS_STATE_DIR", "TUS_MAX_AGE",
+	"SHUTDOWN_GRACE", "REFRESH", "REFRESH_FAILURES", "SSL_CERT_FILE", "DEBUG"}
+
+var (
+	configFile    string
+	currentConfig atomic.Pointer[Config]
+	live          atomic.Pointer[liveSettings]
+	reloadMutex   sync.Mutex
+)
+
+func applyLive(conf *Config) {
+	// Keep the loaded users and keys when the files stay the same
+	old := live.Load()
+	var auth *htpasswd
+	if file := conf.Get("HTPASSWD_FILE"); file != "" {
+		if old != nil && old.htpasswd != nil && old.htpasswd.file == file {
+			auth = old.htpasswd
+		} else {
+			auth = newHtpasswd(file)
+		}
+	}
+	var verifier *jwtVerifier
+	if source := conf.Get("JWT_JWKS"); source != "" {
+		keys := newJWKS(source)
+		if old != nil && old.jwt != nil && old.jwt.keys.source == source {
+			keys = old.jwt.keys
+		}
+		verifier = newJWTVerifier(keys, conf.Get("JWT_ISSUER"), conf.Get("JWT_AUDIENCE"),
+			conf.Get("JWT_USER_CLAIM"), conf.Get("JWT_GROUPS_CLAIM"))
+	}
+	var share *shareSigner
+	if secret := conf.Get("SHARE_SECRET"); secret != "" {
+		share = &shareSigner{secret: []byte(secret), maxAge: conf.Duration("SHARE_MAX_AGE")}
+		if file := conf.Get("SHARE_REVOKED_FILE"); file != "" {
+			share.revoked = &revocationList{file: file}
+			if old != nil && old.share != nil && old.share.revoked != nil && old.share.revoked.file == file {
+				share.revoked = old.share.revoked
+			}
+		}
+	}
+
+	var rules *acl
+	var networks networkRules
+	if conf.ACL != nil {
+		if len(conf.ACL.Rules) > 0 {
+			rules = conf.ACL
+		}
+		networks = conf.ACL.Networks
+	}
+	trusted, _ := parsePrefixes(strings.FieldsFunc(conf.Get("TRUSTED_PROXIES"), splitList))
+
+	var oldLimits rateLimits
+	if old != nil {
+		oldLimits = old.limits
+	}
+
+	currentConfig.Store(conf)
+	live.Store(&liveSettings{
+		directoryIndex:  conf.Fields("DIRECTORY_INDEX"),
+		directoryHeader: conf.Fields("DIRECTORY_HEADER"),
+		directoryFooter: conf.Fields("DIRECTORY_FOOTER"),
+		uploadHeader:    conf.Get("MODIFY_ALLOW_HEADER"),
+		forwardedUser:   conf.Get("FORWARDED_USER_HEADER"),
+		forwardedGroups: conf.Get("FORWARDED_GROUPS_HEADER"),
+		htpasswd:        auth,
+		jwt:             verifier,
+		acl:             rules,
+		networks:        networks,
+		trustedProxies:  trusted,
+		quotas:          conf.Quotas,
+		share:           share,
+		certUser:        strings.ToLower(conf.Get("TLS_CLIENT_USER")),
+		authRealm:       conf.Get("AUTH_REALM"),
+		limits:          newRateLimits(conf, oldLimits),
+	})
+}
+
+// Re-read the config file and the mime types and swap them in.  If anything
+// is invalid the error is returned and the running settings are kept.
+func reload() error {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+
+	conf, errs := loadConfig(configFile)
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	types, err := loadMimeTypes()
+	if err != nil {
+		return err
+	}
+
+	if old := currentConfig.Load(); old != nil {
+		for _, name := range restartSettings {
+			if old.Get(name) != conf.Get(name) {
+				log.Printf("Reload: %s changed from %q to %q, a restart is needed for this to take effect",
+					name, old.Get(name), conf.Get(name))
+			}
+		}
+		if old.routes() != conf.routes() {
+			log.Println("Reload: the bucket routes changed, a restart is needed for this to take effect")
+		}
+	}
+
+	mimeTypes.Store(&types)
+	applyLive(conf)
+	log.Println("Reload: configuration and", len(types), "mime types loaded")
+	return nil
+}
+
+// Reload the configuration whenever a SIGHUP is received.
+func watchReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reload(); err != nil {
+				log.Println("Reload failed, keeping the current configuration:", err)
+			}
+		}
+	}()
+}
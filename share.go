@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// How long a share link is valid when no duration is asked for
+var shareDefaultAge = 24 * time.Hour
+
+// Mints and checks share links, URLs which are signed with the server secret
+// and carry the path, the expiry and the allowed method.
+type shareSigner struct {
+	secret  []byte
+	maxAge  time.Duration
+	revoked *revocationList
+}
+
+// A share link which checked out for the request
+type shareLink struct {
+	ID      string
+	Scope   string // The path, or the folder when ending in "/"
+	Method  string // GET (list and read) or POST (upload)
+	Expires time.Time
+}
+
+// The link is also signed with the bucket and the host it is routed by, so it
+// does not work on another bucket which is mounted on the same path.
+func (s *shareSigner) sign(id, method string, expires int64, b *Bucket, scope string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "v2\n%s\n%s\n%d\n%s\n%s/%s\n%s", id, method, expires,
+		strings.ToLower(b.Host), b.Name, b.Prefix, scope)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// The optional arguments of the share action, the duration and the method
+func parseShareArgs(arg string) (time.Duration, string, error) {
+	age, method := shareDefaultAge, "GET"
+	args := strings.Fields(arg)
+	if len(args) > 0 {
+		var err error
+		if age, err = time.ParseDuration(args[0]); err != nil {
+			return 0, "", fmt.Errorf("invalid share duration: %w", err)
+		}
+	}
+	if len(args) > 1 {
+		method = strings.ToUpper(args[1])
+	}
+	return age, method, nil
+}
+
+// Create a link for the path of the bucket, the returned URL is relative to
+// the host.
+func (s *shareSigner) mint(b *Bucket, scope, method string, age time.Duration) (*shareLink, string, error) {
+	if age <= 0 || age > s.maxAge {
+		return nil, "", fmt.Errorf("duration must be between 0 and %s", s.maxAge)
+	}
+	switch method {
+	case "GET", "POST":
+	default:
+		return nil, "", fmt.Errorf("method %q cannot be shared, use GET or POST", method)
+	}
+	rnd := make([]byte, 8)
+	if _, err := rand.Read(rnd); err != nil {
+		return nil, "", err
+	}
+	link := &shareLink{
+		ID:      hex.EncodeToString(rnd),
+		Scope:   scope,
+		Method:  method,
+		Expires: time.Now().Add(age).Truncate(time.Second),
+	}
+	q := url.Values{}
+	q.Set("share", link.ID)
+	q.Set("method", method)
+	q.Set("expires", strconv.FormatInt(link.Expires.Unix(), 10))
+	if strings.HasSuffix(scope, "/") {
+		q.Set("scope", scope)
+	}
+	q.Set("signature", s.sign(link.ID, method, link.Expires.Unix(), b, scope))
+	return link, (&url.URL{Path: scope}).EscapedPath() + "?" + q.Encode(), nil
+}
+
+// Check the share link in the query of the request, nil when there is none.
+func (s *shareSigner) check(ctx *fasthttp.RequestCtx) (*shareLink, error) {
+	args := ctx.QueryArgs()
+	if !args.Has("share") {
+		return nil, nil
+	}
+	if s == nil {
+		return nil, errors.New("share links are not enabled")
+	}
+	link := &shareLink{
+		ID:     string(args.Peek("share")),
+		Method: string(args.Peek("method")),
+		Scope:  string(args.Peek("scope")),
+	}
+	reqPath := string(ctx.URI().Path())
+	if link.Scope == "" {
+		link.Scope = reqPath
+	}
+	expires, err := strconv.ParseInt(string(args.Peek("expires")), 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid share link")
+	}
+	link.Expires = time.Unix(expires, 0)
+	b, _ := routeBucket(b2s(ctx.Host()), reqPath)
+	if b == nil {
+		return nil, errors.New("share link is not for this path")
+	}
+	sig := s.sign(link.ID, link.Method, expires, b, link.Scope)
+	if !hmac.Equal([]byte(sig), args.Peek("signature")) {
+		return nil, errors.New("invalid share link signature")
+	}
+	if time.Now().After(link.Expires) {
+		return nil, errors.New("share link expired")
+	}
+	if s.revoked != nil && s.revoked.has(link.ID) {
+		return nil, errors.New("share link revoked")
+	}
+	if !link.covers(reqPath) {
+		return nil, errors.New("share link is not for this path")
+	}
+	return link, nil
+}
+
+func (l *shareLink) covers(p string) bool {
+	if strings.HasSuffix(l.Scope, "/") {
+		return strings.HasPrefix(p, l.Scope) && validPath(p)
+	}
+	return p == l.Scope
+}
+
+// Does the link allow the verb on the path?
+func (l *shareLink) allows(verb, p string) bool {
+	if !l.covers(p) {
+		return false
+	}
+	switch l.Method {
+	case "GET":
+		return verb == "read" || verb == "list"
+	case "POST":
+		return verb == "upload"
+	}
+	return false
+}
+
+// The query to keep on the links of a shared folder listing
+func (l *shareLink) query(ctx *fasthttp.RequestCtx) string {
+	q := url.Values{}
+	for _, k := range []string{"share", "method", "expires", "scope", "signature"} {
+		if v := ctx.QueryArgs().Peek(k); len(v) > 0 {
+			q.Set(k, string(v))
+		}
+	}
+	return "?" + q.Encode()
+}
+
+func (l *shareLink) identity() *Identity {
+	return &Identity{User: "share:" + l.ID, Method: "share"}
+}
+
+// The IDs of the share links which have been revoked, one per line, re-read
+// when the file changes.
+type revocationList struct {
+	file  string
+	mutex sync.Mutex
+	mtime time.Time
+	ids   map[string]bool
+}
+
+func (r *revocationList) has(id string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.loadLocked(); err != nil {
+		log.Println("Error loading share revocation list:", err)
+	}
+	return r.ids[id]
+}
+
+func (r *revocationList) loadLocked() error {
+	st, err := os.Stat(r.file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// Nothing has been revoked yet
+			r.ids = nil
+			return nil
+		}
+		return err
+	}
+	if r.ids != nil && st.ModTime().Equal(r.mtime) {
+		return nil
+	}
+	dat, err := os.ReadFile(r.file)
+	if err != nil {
+		return err
+	}
+	ids := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(dat))
+	for scanner.Scan() {
+		if f := strings.Fields(scanner.Text()); len(f) > 0 && f[0][0] != '#' {
+			ids[f[0]] = true
+		}
+	}
+	r.ids, r.mtime = ids, st.ModTime()
+	log.Println(len(ids), "revoked share links loaded from", r.file)
+	return nil
+}
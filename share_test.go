@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestParseShareArgs(t *testing.T) {
+	tests := []struct {
+		arg    string
+		age    time.Duration
+		method string
+		err    bool
+	}{
+		{"", shareDefaultAge, "GET", false},
+		{" ", shareDefaultAge, "GET", false},
+		{"\t ", shareDefaultAge, "GET", false},
+		{"48h", 48 * time.Hour, "GET", false},
+		{" 1h  post ", time.Hour, "POST", false},
+		{"soon", 0, "", true},
+	}
+	for _, tt := range tests {
+		age, method, err := parseShareArgs(tt.arg)
+		if (err != nil) != tt.err || age != tt.age || method != tt.method {
+			t.Errorf("%q: got %s %q %v", tt.arg, age, method, err)
+		}
+	}
+}
+
+func shareRequest(host, uri string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI(uri)
+	ctx.Request.Header.SetHost(host)
+	return ctx
+}
+
+func TestShareLinkBucket(t *testing.T) {
+	saved := buckets
+	defer func() { buckets = saved }()
+	docs := &Bucket{Name: "docs", Host: "docs.example.com", Path: "/"}
+	files := &Bucket{Name: "files", Host: "files.example.com", Path: "/"}
+	buckets = []*Bucket{docs, files}
+
+	s := &shareSigner{secret: []byte(strings.Repeat("s", 32)), maxAge: time.Hour}
+	_, url, err := s.mint(docs, "/reports/", "GET", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host, uri string
+		err       string
+	}{
+		{"docs.example.com", url, ""},
+		{"Docs.Example.com:8443", url, ""},
+		{"files.example.com", url, "signature"},
+		{"other.example.com", url, "not for this path"},
+		{"docs.example.com", strings.Replace(url, "/reports/", "/reports/q3.pdf", 1), ""},
+		{"docs.example.com", strings.Replace(url, "/reports/", "/private/", 1), "not for this path"},
+		{"docs.example.com", strings.Replace(url, "method=GET", "method=POST", 1), "signature"},
+	}
+	for _, tt := range tests {
+		link, err := s.check(shareRequest(tt.host, tt.uri))
+		switch {
+		case tt.err == "" && (err != nil || link == nil):
+			t.Errorf("%s%s: %v", tt.host, tt.uri, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s%s: expected an error with %q, got %v", tt.host, tt.uri, tt.err, err)
+		}
+	}
+}
+
+func TestShareLinkACL(t *testing.T) {
+	b, _ := newFakeS3(t)
+	b.dir.objects = map[string]*DirItem{
+		"":             {isDir: true},
+		"up/":          {isDir: true},
+		"secret/":      {isDir: true},
+		"secret/x.txt": {Name: "x.txt"},
+	}
+	file := filepath.Join(t.TempDir(), "acl.yaml")
+	os.WriteFile(file, []byte(`
+rules:
+  - name: secret
+    path: /secret/**
+    verbs: [read, list]
+    deny: true
+  - name: alice
+    path: /**
+    users: [alice]
+    verbs: [read, list, share]
+`), 0600)
+	a, err := loadACL(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedBuckets, savedLive := buckets, live.Load()
+	defer func() { buckets = savedBuckets; live.Store(savedLive) }()
+	buckets = []*Bucket{b}
+	live.Store(&liveSettings{acl: a, uploadHeader: "X-USER",
+		share: &shareSigner{secret: []byte(strings.Repeat("s", 32)), maxAge: time.Hour}})
+
+	mint := func(uri, args string) *fasthttp.RequestCtx {
+		ctx := shareRequest("files.example.com", uri)
+		ctx.Request.Header.SetMethod("PUT")
+		ctx.Request.Header.Set("X-USER", "alice")
+		ctx.Request.Header.Set("Action", "share "+args)
+		handler(ctx)
+		return ctx
+	}
+
+	// Only sharing and reading, so no link to upload
+	if ctx := mint("/up/", "1h POST"); ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Errorf("expected an upload link to be refused, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	// A link for the top folder still does not read what the rules deny
+	ctx := mint("/", "1h")
+	if ctx.Response.StatusCode() != fasthttp.StatusCreated {
+		t.Fatalf("expected a link, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	var minted struct{ URL string }
+	if err := json.Unmarshal(ctx.Response.Body(), &minted); err != nil {
+		t.Fatal(err)
+	}
+	ctx = shareRequest("files.example.com", strings.Replace(minted.URL, "/?", "/secret/x.txt?", 1))
+	handler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusForbidden || !strings.Contains(string(ctx.Response.Body()), `"secret"`) {
+		t.Errorf("expected the deny rule to apply to the link, got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var (
+	// All S3 calls made for a request use this context, it is canceled when
+	// the shutdown grace period runs out to abort the calls still running.
+	abortCtx, abortRequests = context.WithCancel(context.Background())
+
+	// The requests in flight, including downloads which are still streaming
+	// after the handler has returned.
+	inFlight      = make(map[uint64]*transfer)
+	inFlightMutex sync.Mutex
+)
+
+type transfer struct {
+	method, path string
+	start        time.Time
+	streaming    bool
+	bytes        int64
+}
+
+// Keep track of the requests being handled so a shutdown can report on them.
+func trackRequests(h fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		id := ctx.ID()
+		t := &transfer{method: string(ctx.Method()), path: string(ctx.Path()), start: time.Now()}
+		inFlightMutex.Lock()
+		inFlight[id] = t
+		inFlightMutex.Unlock()
+
+		h(ctx)
+
+		inFlightMutex.Lock()
+		if !t.streaming {
+			delete(inFlight, id)
+		}
+		inFlightMutex.Unlock()
+	}
+}
+
+// A response body which keeps the request in flight until it is closed.
+type trackedBody struct {
+	io.ReadCloser
+	id uint64
+	t  *transfer
+}
+
+func (tb *trackedBody) Read(p []byte) (n int, err error) {
+	n, err = tb.ReadCloser.Read(p)
+	atomic.AddInt64(&tb.t.bytes, int64(n))
+	return
+}
+
+func (tb *trackedBody) Close() error {
+	inFlightMutex.Lock()
+	delete(inFlight, tb.id)
+	inFlightMutex.Unlock()
+	return tb.ReadCloser.Close()
+}
+
+// Wrap a download body so the transfer is tracked until fasthttp closes the
+// stream after the last byte is sent.
+func trackStream(ctx *fasthttp.RequestCtx, body io.ReadCloser) io.ReadCloser {
+	inFlightMutex.Lock()
+	defer inFlightMutex.Unlock()
+	t, ok := inFlight[ctx.ID()]
+	if !ok {
+		return body
+	}
+	t.streaming = true
+	return &trackedBody{ReadCloser: body, id: ctx.ID(), t: t}
+}
+
+// Stop accepting connections on SIGTERM or SIGINT and let the active transfers
+// finish within the grace period.  Anything still running after that has its
+// S3 calls aborted and is logged.  The returned channel is closed when the
+// shutdown is complete.
+func shutdownOnSignal(s *fasthttp.Server, grace time.Duration) chan struct{} {
+	done := make(chan struct{})
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		defer close(done)
+		got := <-sig
+		inFlightMutex.Lock()
+		count := len(inFlight)
+		inFlightMutex.Unlock()
+		log.Printf("Received %s, shutting down with %d requests in flight (grace period %s)", got, count, grace)
+
+		ctx, cancel := context.WithTimeout(context.Background(), grace)
+		defer cancel()
+		go func() {
+			// A second signal skips the rest of the grace period
+			<-sig
+			cancel()
+		}()
+		if err := s.ShutdownWithContext(ctx); err == nil {
+			log.Println("All requests finished, shutdown complete")
+			return
+		}
+
+		// Abort what is left and report on it
+		abortRequests()
+		inFlightMutex.Lock()
+		var interrupted []*transfer
+		for _, t := range inFlight {
+			interrupted = append(interrupted, t)
+		}
+		inFlightMutex.Unlock()
+		sort.Slice(interrupted, func(i, j int) bool { return interrupted[i].start.Before(interrupted[j].start) })
+
+		log.Printf("Grace period over, %d of %d requests interrupted:", len(interrupted), count)
+		for _, t := range interrupted {
+			log.Printf("  %s %s after %s, %d bytes sent", t.method, t.path,
+				time.Since(t.start).Round(time.Millisecond), atomic.LoadInt64(&t.bytes))
+		}
+	}()
+	return done
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Serves the certificate and key from disk, loading them again when either
+// file changes so a rotated certificate is picked up without a restart.
+type certReloader struct {
+	certFile, keyFile string
+	mutex             sync.Mutex
+	cert              *tls.Certificate
+	certTime, keyTime time.Time
+}
+
+func (c *certReloader) load() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.loadLocked()
+}
+
+func (c *certReloader) loadLocked() error {
+	certStat, err := os.Stat(c.certFile)
+	if err != nil {
+		return err
+	}
+	keyStat, err := os.Stat(c.keyFile)
+	if err != nil {
+		return err
+	}
+	if c.cert != nil && certStat.ModTime().Equal(c.certTime) && keyStat.ModTime().Equal(c.keyTime) {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	c.cert, c.certTime, c.keyTime = &cert, certStat.ModTime(), keyStat.ModTime()
+	log.Printf("Loaded TLS certificate %s for %s, expires %s", c.certFile, cert.Leaf.Subject,
+		cert.Leaf.NotAfter.UTC().Format(time.RFC1123))
+	return nil
+}
+
+// The tls.Config GetCertificate hook.  A certificate which fails to load (for
+// example while the files are being replaced) keeps the previous one in use.
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err := c.loadLocked(); err != nil {
+		log.Println("Error reloading TLS certificate, keeping the current one:", err)
+	}
+	if c.cert == nil {
+		return nil, errors.New("no TLS certificate loaded")
+	}
+	return c.cert, nil
+}
+
+// Build the TLS config for the listener, with client certificates verified
+// against the CA bundle when one is given.
+func newTLSConfig(certFile, keyFile, clientCAFile string, requireClientCert bool) (*tls.Config, error) {
+	certs := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := certs.load(); err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.getCertificate,
+	}
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", clientCAFile)
+		}
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if requireClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return cfg, nil
+}
+
+// The identity of a verified client certificate.  The user is taken from the
+// subject common name or the first SAN of the given kind (email, dns or uri),
+// and the groups from the subject organizational units.
+func certIdentity(cert *x509.Certificate, field string) *Identity {
+	var user string
+	switch field {
+	case "cn":
+		user = cert.Subject.CommonName
+	case "email":
+		if len(cert.EmailAddresses) > 0 {
+			user = cert.EmailAddresses[0]
+		}
+	case "dns":
+		if len(cert.DNSNames) > 0 {
+			user = cert.DNSNames[0]
+		}
+	case "uri":
+		if len(cert.URIs) > 0 {
+			user = cert.URIs[0].String()
+		}
+	}
+	if user == "" {
+		return nil
+	}
+	return &Identity{User: user, Groups: cert.Subject.OrganizationalUnit, Method: "cert"}
+}
+
+func checkCertField(v string) error {
+	switch strings.ToLower(v) {
+	case "cn", "email", "dns", "uri":
+		return nil
+	}
+	return errors.New("expected one of cn, email, dns or uri")
+}
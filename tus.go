@@ -0,0 +1,684 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/valyala/fasthttp"
+)
+
+// Resumable uploads with the tus protocol (https://tus.io/protocols/resumable-upload),
+// an upload is created with a POST and then sent in any number of PATCH
+// requests, each starting where the last one stopped.
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,checksum,expiration"
+	tusChecksums  = "sha1,sha256,crc32,crc32c"
+	tusMaxSize    = 5 << 40 // The largest object S3 takes
+
+	// The status for a PATCH whose Upload-Checksum does not match
+	statusChecksumMismatch = 460
+)
+
+var (
+	errPatchChecksum = errors.New("460 checksum mismatch: the data does not match the Upload-Checksum")
+	errPastLength    = errors.New("413 request entity too large: the body goes past the Upload-Length")
+)
+
+// The state of a tus upload, kept in TUS_STATE_DIR so uploads survive a
+// restart.  Whole parts are sent to S3 as a multipart upload, the data which
+// does not fill a part yet is kept in a file next to the state between
+// TailStart and TailEnd.  The last part always stays in that file until the
+// upload is done, so a failure to complete it can be retried.
+type tusUpload struct {
+	ID          string
+	Bucket      string
+	Key         string
+	User        string
+	Length      int64
+	PartSize    int64
+	ContentType string
+	Metadata    map[string]string // The metadata of the object
+	TusMetadata string            // Upload-Metadata as given on creation
+	Algorithm   types.ChecksumAlgorithm
+	Checksum    string // The base64 checksum of the whole object asked for, if any
+	Hash        []byte // The checksum state of the parts which were sent
+	UploadID    string // The multipart upload, once the first part is sent
+	Parts       []types.CompletedPart
+	Stored      int64 // The bytes in the parts
+	TailStart   int64
+	TailEnd     int64
+	Created     time.Time
+	Updated     time.Time
+}
+
+func (u *tusUpload) offset() int64 {
+	return u.Stored + u.TailEnd - u.TailStart
+}
+
+// The checksum of the parts sent so far
+func (u *tusUpload) hash() hash.Hash {
+	full := newChecksumHash(u.Algorithm)
+	if len(u.Hash) > 0 {
+		full.(encoding.BinaryUnmarshaler).UnmarshalBinary(u.Hash)
+	}
+	return full
+}
+
+// The uploads in progress, each one is only worked on by one request at a time.
+type tusStore struct {
+	dir    string
+	maxAge time.Duration
+	mutex  sync.Mutex
+	busy   map[string]bool
+}
+
+var tusUploads *tusStore
+
+func newTusStore(dir string, maxAge time.Duration) (*tusStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	t := &tusStore{dir: dir, maxAge: maxAge, busy: make(map[string]bool)}
+	go func() {
+		for range time.Tick(10 * time.Minute) {
+			t.expire()
+		}
+	}()
+	return t, nil
+}
+
+func (t *tusStore) stateFile(id string) string { return filepath.Join(t.dir, id+".json") }
+func (t *tusStore) tailFile(id string) string  { return filepath.Join(t.dir, id+".part") }
+
+func (t *tusStore) lock(id string) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.busy[id] {
+		return false
+	}
+	t.busy[id] = true
+	return true
+}
+
+func (t *tusStore) unlock(id string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.busy, id)
+}
+
+func (t *tusStore) load(id string) (*tusUpload, error) {
+	dat, err := os.ReadFile(t.stateFile(id))
+	if err != nil {
+		return nil, err
+	}
+	u := &tusUpload{}
+	if err := json.Unmarshal(dat, u); err != nil {
+		return nil, fmt.Errorf("%s: %w", t.stateFile(id), err)
+	}
+	return u, nil
+}
+
+// Write the state, replacing the old one in one go
+func (t *tusStore) save(u *tusUpload) error {
+	dat, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	tmp := t.stateFile(u.ID) + ".tmp"
+	if err := os.WriteFile(tmp, dat, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, t.stateFile(u.ID))
+}
+
+func (t *tusStore) remove(u *tusUpload) {
+	os.Remove(t.stateFile(u.ID))
+	os.Remove(t.tailFile(u.ID))
+}
+
+// Throw away an upload along with the parts sent to S3
+func (t *tusStore) discard(u *tusUpload, why error) {
+	if u.UploadID != "" {
+		for _, b := range buckets {
+			if b.Name == u.Bucket && strings.HasPrefix(u.Key, b.Prefix) {
+				b.abortMultipart(u.Key, u.UploadID, why)
+				break
+			}
+		}
+	}
+	t.remove(u)
+	log.Printf("Discarded tus upload %s of %s/%s: %v", u.ID, u.Bucket, u.Key, why)
+}
+
+// Throw away the uploads which have not been touched for TUS_MAX_AGE
+func (t *tusStore) expire() {
+	files, _ := filepath.Glob(filepath.Join(t.dir, "*.json"))
+	for _, f := range files {
+		id := strings.TrimSuffix(filepath.Base(f), ".json")
+		if !t.lock(id) {
+			continue
+		}
+		if u, err := t.load(id); err != nil {
+			log.Println("Error reading tus upload:", err)
+		} else if time.Since(u.Updated) > t.maxAge {
+			t.discard(u, errors.New("expired"))
+		}
+		t.unlock(id)
+	}
+}
+
+func (t *tusStore) expires(u *tusUpload) string {
+	return u.Updated.Add(t.maxAge).UTC().Format(time.RFC1123)
+}
+
+// Is the request part of the tus protocol?
+func isTusRequest(ctx *fasthttp.RequestCtx, method string) bool {
+	switch method {
+	case "POST":
+		return len(ctx.Request.Header.Peek("Tus-Resumable")) > 0
+	case "PATCH":
+		return true
+	case "HEAD", "DELETE":
+		return ctx.QueryArgs().Has("tus")
+	}
+	return false
+}
+
+// Tell a tus client what is supported
+func tusOptions(ctx *fasthttp.RequestCtx) {
+	ctx.Response.Header.Set("Tus-Resumable", tusVersion)
+	ctx.Response.Header.Set("Tus-Version", tusVersion)
+	ctx.Response.Header.Set("Tus-Extension", tusExtensions)
+	ctx.Response.Header.Set("Tus-Max-Size", strconv.FormatInt(tusMaxSize, 10))
+	ctx.Response.Header.Set("Tus-Checksum-Algorithm", tusChecksums)
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// Parse the Upload-Metadata header, pairs of a key and a base64 value
+// separated by commas.
+func parseTusMetadata(v string) map[string]string {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(v, ",") {
+		key, val, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+		dat, _ := base64.StdEncoding.DecodeString(strings.TrimSpace(val))
+		meta[key] = string(dat)
+	}
+	return meta
+}
+
+// The file name in the metadata of an upload into a folder, empty when there
+// is no usable name.
+func tusFilename(ctx *fasthttp.RequestCtx) string {
+	meta := parseTusMetadata(string(ctx.Request.Header.Peek("Upload-Metadata")))
+	name := meta["filename"]
+	if name == "" {
+		name = meta["name"]
+	}
+	// Drop any folders of the client
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	switch name {
+	case ".", "..", "/":
+		return ""
+	}
+	return name
+}
+
+func tusUser(id *Identity) string {
+	if id == nil {
+		return ""
+	}
+	return id.User
+}
+
+// Handle a tus request for the path, after the caller was allowed to upload
+// to it.
+func (t *tusStore) serve(ctx *fasthttp.RequestCtx, method string, ls *liveSettings, b *Bucket, uri string, id *Identity, client rateKeys) {
+	// ctx.Error clears the headers, so this is set on the way out
+	defer ctx.Response.Header.Set("Tus-Resumable", tusVersion)
+	ctx.Response.Header.Set("Cache-Control", "no-store")
+	if v := string(ctx.Request.Header.Peek("Tus-Resumable")); v != tusVersion {
+		ctx.Error("412 precondition failed: unsupported Tus-Resumable version "+strconv.Quote(v), fasthttp.StatusPreconditionFailed)
+		ctx.Response.Header.Set("Tus-Version", tusVersion)
+		return
+	}
+	if method == "POST" {
+		t.create(ctx, ls, b, uri, id)
+		return
+	}
+
+	tid := string(ctx.QueryArgs().Peek("tus"))
+	if _, err := hex.DecodeString(tid); err != nil || len(tid) != 32 {
+		ctx.Error("404 unknown upload: "+tid, fasthttp.StatusNotFound)
+		return
+	}
+	if !t.lock(tid) {
+		ctx.Error("423 locked: the upload is in use by another request", fasthttp.StatusLocked)
+		return
+	}
+	defer t.unlock(tid)
+	u, err := t.load(tid)
+	if err != nil || u.Bucket != b.Name || u.Key != b.key(uri) {
+		if err != nil && !os.IsNotExist(err) {
+			log.Println("Error reading tus upload:", err)
+		}
+		ctx.Error("404 unknown upload: "+tid, fasthttp.StatusNotFound)
+		return
+	}
+	if u.User != tusUser(id) {
+		ctx.Error("403 forbidden: the upload was started by another user", fasthttp.StatusForbidden)
+		return
+	}
+	if time.Since(u.Updated) > t.maxAge {
+		t.discard(u, errors.New("expired"))
+		ctx.Error("410 gone: the upload expired", fasthttp.StatusGone)
+		return
+	}
+
+	switch method {
+	case "HEAD":
+		ctx.Response.Header.Set("Upload-Offset", strconv.FormatInt(u.offset(), 10))
+		ctx.Response.Header.Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+		if u.TusMetadata != "" {
+			ctx.Response.Header.Set("Upload-Metadata", u.TusMetadata)
+		}
+		ctx.Response.Header.Set("Upload-Expires", t.expires(u))
+		ctx.SetStatusCode(fasthttp.StatusOK)
+	case "PATCH":
+		t.patch(ctx, ls, b, uri, u, client)
+	case "DELETE":
+		t.discard(u, errors.New("terminated by "+id.String()))
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+	}
+}
+
+// Start an upload, nothing is sent to S3 until the first part is full.
+func (t *tusStore) create(ctx *fasthttp.RequestCtx, ls *liveSettings, b *Bucket, uri string, id *Identity) {
+	length, err := strconv.ParseInt(string(ctx.Request.Header.Peek("Upload-Length")), 10, 64)
+	if err != nil || length < 0 {
+		ctx.Error("400 bad request: a valid Upload-Length is required", fasthttp.StatusBadRequest)
+		return
+	}
+	if length > tusMaxSize {
+		ctx.Error("413 request entity too large: the largest upload is "+strconv.FormatInt(tusMaxSize, 10), fasthttp.StatusRequestEntityTooLarge)
+		return
+	}
+	if !ls.quotas.allow(ctx, b, uri, id, length) {
+		return
+	}
+
+	rnd := make([]byte, 16)
+	if _, err := rand.Read(rnd); err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	u := &tusUpload{
+		ID:          hex.EncodeToString(rnd),
+		Bucket:      b.Name,
+		Key:         b.key(uri),
+		User:        tusUser(id),
+		Length:      length,
+		PartSize:    partSizeFor(length),
+		TusMetadata: string(ctx.Request.Header.Peek("Upload-Metadata")),
+		Algorithm:   types.ChecksumAlgorithmSha256,
+		Created:     now,
+		Updated:     now,
+	}
+	// The same headers as a POST, for the date and checksum of the whole object
+	in, err := b.putInput(uri, parseTusMetadata(u.TusMetadata)["filetype"],
+		ctx.Request.Header.Peek("Content-Date"), ctx.Request.Header.Peek("Checksum"))
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusExpectationFailed)
+		return
+	}
+	u.ContentType = *in.ContentType
+	if len(in.ChecksumAlgorithm) != 0 {
+		u.Algorithm, u.Checksum = in.ChecksumAlgorithm, wantedChecksum(in)
+		sum, _ := base64.StdEncoding.DecodeString(u.Checksum)
+		in.Metadata["checksum"] = fmt.Sprintf("{%s}%02x", checksumName(u.Algorithm), sum)
+	}
+	u.Metadata = in.Metadata
+
+	location := (&url.URL{Path: b.Path + uri, RawQuery: "tus=" + u.ID}).String()
+	if length == 0 {
+		// Nothing to wait for
+		if _, err := t.finish(b, u, nil); err != nil {
+			ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+			return
+		}
+		b.recordPut(uri, 0)
+		ctx.Response.Header.Set("Location", location)
+		ctx.SetStatusCode(fasthttp.StatusCreated)
+		return
+	}
+	if err := t.save(u); err != nil {
+		log.Println("Error saving tus upload:", err)
+		ctx.Error("500 the upload could not be saved", fasthttp.StatusInternalServerError)
+		return
+	}
+	log.Printf("Started tus upload %s of %s/%s, %d bytes, by %s", u.ID, u.Bucket, u.Key, u.Length, id)
+	ctx.Response.Header.Set("Location", location)
+	ctx.Response.Header.Set("Upload-Expires", t.expires(u))
+	ctx.SetStatusCode(fasthttp.StatusCreated)
+}
+
+// Add the body to the upload at its offset.  Failures which may go away, like
+// S3 being unreachable, are a 500 so tus clients try again.
+func (t *tusStore) patch(ctx *fasthttp.RequestCtx, ls *liveSettings, b *Bucket, uri string, u *tusUpload, client rateKeys) {
+	if ct := string(ctx.Request.Header.Peek("Content-Type")); ct != "application/offset+octet-stream" {
+		ctx.Error("415 unsupported media type: expected application/offset+octet-stream", fasthttp.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(string(ctx.Request.Header.Peek("Upload-Offset")), 10, 64)
+	if err != nil {
+		ctx.Error("400 bad request: a valid Upload-Offset is required", fasthttp.StatusBadRequest)
+		return
+	}
+	if offset != u.offset() {
+		ctx.Error(fmt.Sprintf("409 conflict: Upload-Offset %d does not match the upload at %d", offset, u.offset()), fasthttp.StatusConflict)
+		return
+	}
+	contentLength := int64(ctx.Request.Header.ContentLength())
+	if contentLength < -1 {
+		ctx.Error("411 length required", fasthttp.StatusLengthRequired)
+		return
+	}
+	if offset+contentLength > u.Length {
+		ctx.Error(errPastLength.Error(), fasthttp.StatusRequestEntityTooLarge)
+		return
+	}
+	known := contentLength
+	if known < 0 {
+		known = 0
+	}
+	if !ls.limits.allow(ctx, "write-bytes", client, float64(known)) {
+		if contentLength < 0 {
+			ctx.SetConnectionClose()
+		}
+		return
+	}
+
+	// The optional checksum of this PATCH, like "sha1 <base64>"
+	var check *patchCheck
+	if v := string(ctx.Request.Header.Peek("Upload-Checksum")); v != "" {
+		name, sum, _ := strings.Cut(v, " ")
+		var alg types.ChecksumAlgorithm
+		switch name {
+		case "sha1":
+			alg = types.ChecksumAlgorithmSha1
+		case "sha256":
+			alg = types.ChecksumAlgorithmSha256
+		case "crc32":
+			alg = types.ChecksumAlgorithmCrc32
+		case "crc32c":
+			alg = types.ChecksumAlgorithmCrc32c
+		default:
+			ctx.Error("400 bad request: unsupported checksum algorithm "+strconv.Quote(name)+", use one of "+tusChecksums, fasthttp.StatusBadRequest)
+			return
+		}
+		check = &patchCheck{h: newChecksumHash(alg), want: strings.TrimSpace(sum)}
+	}
+
+	var body io.Reader = bytes.NewReader(nil)
+	if contentLength != 0 {
+		body = ctx.RequestBodyStream()
+	}
+	body = io.LimitReader(body, u.Length-offset)
+	written, err := t.write(b, u, body, check)
+	if err == nil && contentLength < 0 {
+		// A chunked body may still go on past the Upload-Length
+		if n, _ := ctx.RequestBodyStream().Read(make([]byte, 1)); n > 0 {
+			// The last part is sent again, like when it fails to complete
+			err, u.TailEnd = errPastLength, u.TailStart
+			t.save(u)
+		}
+	}
+	ls.limits.charge("write-bytes", client, float64(written-known))
+	if a, ok := ctx.UserValue("audit").(*auditEntry); ok {
+		a.Bytes = written
+	}
+
+	var checksum string
+	if err == nil && u.offset() == u.Length {
+		if checksum, err = t.finish(b, u, nil); err == nil {
+			b.recordPut(uri, u.Length)
+			if a, ok := ctx.UserValue("audit").(*auditEntry); ok {
+				a.Checksum = checksum
+			}
+			log.Printf("Finished tus upload %s of %s/%s, %s", u.ID, u.Bucket, u.Key, checksum)
+		}
+	}
+
+	switch {
+	case err == nil:
+		ctx.Response.Header.Set("Upload-Offset", strconv.FormatInt(u.offset(), 10))
+		if checksum != "" {
+			ctx.Response.Header.Set("ETag", fmt.Sprintf("%q", checksum))
+		} else {
+			ctx.Response.Header.Set("Upload-Expires", t.expires(u))
+		}
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+	case errors.Is(err, errPatchChecksum):
+		ctx.Error(err.Error(), statusChecksumMismatch)
+	case errors.Is(err, errChecksumMismatch):
+		ctx.Error(err.Error(), fasthttp.StatusExpectationFailed)
+	case errors.Is(err, errPastLength):
+		ctx.Error(err.Error(), fasthttp.StatusRequestEntityTooLarge)
+	default:
+		log.Printf("Error in tus upload %s of %s/%s: %v", u.ID, u.Bucket, u.Key, err)
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+	}
+	if err != nil && contentLength < 0 {
+		ctx.SetConnectionClose()
+	}
+}
+
+// The checksum a PATCH is checked against
+type patchCheck struct {
+	h    hash.Hash
+	want string
+}
+
+// Append the body to the tail file, sending the parts which fill up.  Without
+// a checksum whatever arrives is kept, so a dropped connection loses nothing,
+// with a checksum the body is only kept once it checks out.  The bytes added
+// to the upload are returned.
+func (t *tusStore) write(b *Bucket, u *tusUpload, body io.Reader, check *patchCheck) (int64, error) {
+	f, err := os.OpenFile(t.tailFile(u.ID), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	// Anything past the end is left over from a body which did not check out
+	// or a crash
+	if err := f.Truncate(u.TailEnd); err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(u.TailEnd, io.SeekStart); err != nil {
+		return 0, err
+	}
+	start := u.offset()
+	u.Updated = time.Now()
+
+	if check != nil {
+		n, err := io.Copy(f, io.TeeReader(body, check.h))
+		if err != nil {
+			return 0, err
+		}
+		if base64.StdEncoding.EncodeToString(check.h.Sum(nil)) != check.want {
+			return 0, errPatchChecksum
+		}
+		u.TailEnd += n
+		if err := t.flush(b, u, f); err != nil {
+			return u.offset() - start, err
+		}
+		return u.offset() - start, t.save(u)
+	}
+
+	for {
+		room := u.PartSize - (u.TailEnd - u.TailStart)
+		if room <= 0 {
+			// The last part, the body can't go past the end
+			room = u.PartSize
+		}
+		n, rerr := io.CopyN(f, body, room)
+		u.TailEnd += n
+		if err := t.flush(b, u, f); err != nil {
+			return u.offset() - start, err
+		}
+		if rerr == io.EOF {
+			break
+		} else if rerr != nil {
+			// Keep what did arrive for the client to carry on from
+			t.save(u)
+			return u.offset() - start, rerr
+		}
+	}
+	return u.offset() - start, t.save(u)
+}
+
+// Send the full parts in the tail file, except for the last part.
+func (t *tusStore) flush(b *Bucket, u *tusUpload, f *os.File) error {
+	var chunk []byte
+	for u.TailEnd-u.TailStart >= u.PartSize && u.Stored+u.PartSize < u.Length {
+		if u.UploadID == "" {
+			in := &s3.PutObjectInput{
+				Bucket:      &b.Name,
+				Key:         &u.Key,
+				ContentType: &u.ContentType,
+				Metadata:    u.Metadata,
+			}
+			id, err := b.createMultipart(in, u.Algorithm)
+			if err != nil {
+				return err
+			}
+			u.UploadID = id
+			if err := t.save(u); err != nil {
+				return err
+			}
+		}
+		if chunk == nil {
+			chunk = partBuffers.get(u.PartSize)
+			defer partBuffers.put(chunk)
+		}
+		if _, err := f.ReadAt(chunk, u.TailStart); err != nil {
+			return err
+		}
+		part, err := b.uploadPart(u.Key, u.UploadID, int32(len(u.Parts)+1), chunk, u.Algorithm)
+		if err != nil {
+			return err
+		}
+		h := u.hash()
+		h.Write(chunk)
+		u.Hash, _ = h.(encoding.BinaryMarshaler).MarshalBinary()
+		u.Parts = append(u.Parts, part)
+		u.Stored += u.PartSize
+		u.TailStart += u.PartSize
+		if err := t.save(u); err != nil {
+			return err
+		}
+	}
+	if u.TailStart > 0 && u.TailStart == u.TailEnd {
+		// Start the tail file over, the state first so a crash in between
+		// only leaves data past the end
+		u.TailStart, u.TailEnd = 0, 0
+		if err := t.save(u); err != nil {
+			return err
+		}
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		_, err := f.Seek(0, io.SeekStart)
+		return err
+	}
+	return nil
+}
+
+// Send the last part and complete the upload, returning the checksum of the
+// object.  When this fails the last part is dropped, so the client sends it
+// again and the upload is completed on that PATCH.
+func (t *tusStore) finish(b *Bucket, u *tusUpload, f *os.File) (string, error) {
+	rest := make([]byte, u.TailEnd-u.TailStart)
+	if len(rest) > 0 {
+		if f == nil {
+			var err error
+			if f, err = os.Open(t.tailFile(u.ID)); err != nil {
+				return "", err
+			}
+			defer f.Close()
+		}
+		if _, err := f.ReadAt(rest, u.TailStart); err != nil {
+			return "", err
+		}
+	}
+	h := u.hash()
+	h.Write(rest)
+	sum := h.Sum(nil)
+	checksum := fmt.Sprintf("{%s}%02x", checksumName(u.Algorithm), sum)
+	if u.Checksum != "" && u.Checksum != base64.StdEncoding.EncodeToString(sum) {
+		err := fmt.Errorf("%w: the upload has %s", errChecksumMismatch, checksum)
+		t.discard(u, err)
+		return "", err
+	}
+
+	var err error
+	if u.UploadID == "" {
+		in := &s3.PutObjectInput{
+			Bucket:        &b.Name,
+			Key:           &u.Key,
+			ContentType:   &u.ContentType,
+			ContentLength: int64(len(rest)),
+			Metadata:      u.Metadata,
+			Body:          bytes.NewReader(rest),
+		}
+		if !plainEndpoint() {
+			in.ChecksumAlgorithm = u.Algorithm
+		}
+		_, err = b.S3().PutObject(abortCtx, in)
+	} else {
+		var part types.CompletedPart
+		if part, err = b.uploadPart(u.Key, u.UploadID, int32(len(u.Parts)+1), rest, u.Algorithm); err == nil {
+			err = b.completeMultipart(u.Key, u.UploadID, append(u.Parts, part))
+		}
+		if err == nil && u.Checksum == "" {
+			if terr := b.tagChecksum(u.Key, checksum); terr != nil {
+				log.Printf("Error tagging the checksum of %s/%s: %v", b.Name, u.Key, terr)
+			}
+		}
+	}
+	if err != nil {
+		u.TailEnd = u.TailStart
+		if serr := t.save(u); serr != nil {
+			log.Println("Error saving tus upload:", serr)
+		}
+		return "", err
+	}
+	t.remove(u)
+	if debug {
+		log.Printf("Tus upload of %s/%s done in %d parts, %s", b.Name, u.Key, len(u.Parts)+1, checksum)
+	}
+	return checksum, nil
+}
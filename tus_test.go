@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// A store in a temporary folder for a bucket on a fake S3, with small parts
+func newTestTus(t *testing.T) (*tusStore, *Bucket, *fakeS3) {
+	t.Helper()
+	b, f := newFakeS3(t)
+	savedBuckets, savedPartSize := buckets, multipartPartSize
+	buckets, multipartPartSize = []*Bucket{b}, 1000
+	t.Cleanup(func() { buckets, multipartPartSize = savedBuckets, savedPartSize })
+	return &tusStore{dir: t.TempDir(), maxAge: time.Hour, busy: make(map[string]bool)}, b, f
+}
+
+// Send a tus request to the store, the headers are name and value pairs
+func tusRequest(ts *tusStore, b *Bucket, method, uri, tid string, body []byte, headers ...string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI("/" + uri + "?tus=" + tid)
+	ctx.Request.Header.Set("Tus-Resumable", tusVersion)
+	for i := 0; i+1 < len(headers); i += 2 {
+		ctx.Request.Header.Set(headers[i], headers[i+1])
+	}
+	if method == "PATCH" {
+		ctx.Request.Header.Set("Content-Type", "application/offset+octet-stream")
+		ctx.Request.SetBodyStream(bytes.NewReader(body), len(body))
+	}
+	ts.serve(ctx, method, &liveSettings{}, b, uri, nil, rateKeys{"ip:127.0.0.1"})
+	return ctx
+}
+
+// Start an upload, returning its id
+func tusCreate(t *testing.T, ts *tusStore, b *Bucket, uri string, length int) string {
+	t.Helper()
+	ctx := tusRequest(ts, b, "POST", uri, "", nil, "Upload-Length", strconv.Itoa(length))
+	if ctx.Response.StatusCode() != fasthttp.StatusCreated {
+		t.Fatalf("create: %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	_, tid, _ := strings.Cut(string(ctx.Response.Header.Peek("Location")), "tus=")
+	return tid
+}
+
+func tusOffset(ts *tusStore, b *Bucket, uri, tid string) string {
+	ctx := tusRequest(ts, b, "HEAD", uri, tid, nil)
+	return string(ctx.Response.Header.Peek("Upload-Offset"))
+}
+
+func TestTusHeaders(t *testing.T) {
+	ts, b, _ := newTestTus(t)
+
+	ctx := &fasthttp.RequestCtx{}
+	tusOptions(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusNoContent {
+		t.Errorf("OPTIONS gave %d", ctx.Response.StatusCode())
+	}
+	for name, want := range map[string]string{
+		"Tus-Resumable":          tusVersion,
+		"Tus-Version":            tusVersion,
+		"Tus-Extension":          tusExtensions,
+		"Tus-Checksum-Algorithm": tusChecksums,
+		"Tus-Max-Size":           strconv.Itoa(tusMaxSize),
+	} {
+		if got := string(ctx.Response.Header.Peek(name)); got != want {
+			t.Errorf("OPTIONS %s: got %q, expected %q", name, got, want)
+		}
+	}
+
+	meta := "filename " + base64.StdEncoding.EncodeToString([]byte("a.txt"))
+	ctx = tusRequest(ts, b, "POST", "a.txt", "", nil, "Upload-Length", "10", "Upload-Metadata", meta)
+	if ctx.Response.StatusCode() != fasthttp.StatusCreated {
+		t.Fatalf("create: %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	location := string(ctx.Response.Header.Peek("Location"))
+	if !strings.HasPrefix(location, "/a.txt?tus=") || len(location) != len("/a.txt?tus=")+32 {
+		t.Errorf("unexpected Location %q", location)
+	}
+	if string(ctx.Response.Header.Peek("Tus-Resumable")) != tusVersion || len(ctx.Response.Header.Peek("Upload-Expires")) == 0 {
+		t.Errorf("missing headers in %s", ctx.Response.Header.String())
+	}
+
+	tid := location[len("/a.txt?tus="):]
+	ctx = tusRequest(ts, b, "HEAD", "a.txt", tid, nil)
+	if string(ctx.Response.Header.Peek("Upload-Length")) != "10" || string(ctx.Response.Header.Peek("Upload-Metadata")) != meta {
+		t.Errorf("unexpected HEAD %s", ctx.Response.Header.String())
+	}
+
+	// Without the version the request is refused
+	ctx = &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod("POST")
+	ctx.Request.Header.Set("Upload-Length", "10")
+	ts.serve(ctx, "POST", &liveSettings{}, b, "a.txt", nil, nil)
+	if ctx.Response.StatusCode() != fasthttp.StatusPreconditionFailed {
+		t.Errorf("a request without Tus-Resumable gave %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestTusPatchOffsets(t *testing.T) {
+	ts, b, _ := newTestTus(t)
+	tid := tusCreate(t, ts, b, "a.bin", 2500)
+
+	ctx := tusRequest(ts, b, "PATCH", "a.bin", tid, []byte("abc"), "Upload-Offset", "5")
+	if ctx.Response.StatusCode() != fasthttp.StatusConflict {
+		t.Errorf("PATCH at a wrong offset gave %d", ctx.Response.StatusCode())
+	}
+
+	ctx = tusRequest(ts, b, "PATCH", "a.bin", tid, bytes.Repeat([]byte("x"), 300), "Upload-Offset", "0")
+	if ctx.Response.StatusCode() != fasthttp.StatusNoContent || string(ctx.Response.Header.Peek("Upload-Offset")) != "300" {
+		t.Fatalf("PATCH gave %d at %s", ctx.Response.StatusCode(), ctx.Response.Header.Peek("Upload-Offset"))
+	}
+	if got := tusOffset(ts, b, "a.bin", tid); got != "300" {
+		t.Errorf("HEAD gave Upload-Offset %q after a partial PATCH", got)
+	}
+
+	// The old offset is now wrong too
+	ctx = tusRequest(ts, b, "PATCH", "a.bin", tid, []byte("abc"), "Upload-Offset", "0")
+	if ctx.Response.StatusCode() != fasthttp.StatusConflict {
+		t.Errorf("PATCH at the old offset gave %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestTusPatchChecksum(t *testing.T) {
+	ts, b, _ := newTestTus(t)
+	tid := tusCreate(t, ts, b, "a.bin", 100)
+
+	data := []byte("0123456789")
+	wrong := sha256.Sum256([]byte("something else"))
+	ctx := tusRequest(ts, b, "PATCH", "a.bin", tid, data, "Upload-Offset", "0",
+		"Upload-Checksum", "sha256 "+base64.StdEncoding.EncodeToString(wrong[:]))
+	if ctx.Response.StatusCode() != statusChecksumMismatch {
+		t.Errorf("a wrong Upload-Checksum gave %d", ctx.Response.StatusCode())
+	}
+	if got := tusOffset(ts, b, "a.bin", tid); got != "0" {
+		t.Errorf("the body which did not check out was kept, Upload-Offset %q", got)
+	}
+
+	right := sha256.Sum256(data)
+	ctx = tusRequest(ts, b, "PATCH", "a.bin", tid, data, "Upload-Offset", "0",
+		"Upload-Checksum", "sha256 "+base64.StdEncoding.EncodeToString(right[:]))
+	if ctx.Response.StatusCode() != fasthttp.StatusNoContent || tusOffset(ts, b, "a.bin", tid) != "10" {
+		t.Errorf("a right Upload-Checksum gave %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestTusResume(t *testing.T) {
+	ts, b, f := newTestTus(t)
+	data := bytes.Repeat([]byte("0123456789"), 250)
+	tid := tusCreate(t, ts, b, "big.bin", len(data))
+
+	// One part goes to S3, the rest waits in the tail file
+	ctx := tusRequest(ts, b, "PATCH", "big.bin", tid, data[:1500], "Upload-Offset", "0")
+	if ctx.Response.StatusCode() != fasthttp.StatusNoContent {
+		t.Fatalf("PATCH gave %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+
+	// As after a restart
+	ts = &tusStore{dir: ts.dir, maxAge: ts.maxAge, busy: make(map[string]bool)}
+	if got := tusOffset(ts, b, "big.bin", tid); got != "1500" {
+		t.Fatalf("the reopened store gave Upload-Offset %q", got)
+	}
+	ctx = tusRequest(ts, b, "PATCH", "big.bin", tid, data[1500:], "Upload-Offset", "1500")
+	if ctx.Response.StatusCode() != fasthttp.StatusNoContent {
+		t.Fatalf("PATCH gave %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	want := fmt.Sprintf(`"{SHA256}%x"`, sha256.Sum256(data))
+	if got := string(ctx.Response.Header.Peek("ETag")); got != want {
+		t.Errorf("got ETag %s, expected %s", got, want)
+	}
+	if obj := f.object("big.bin"); obj == nil || !bytes.Equal(obj.data, data) {
+		t.Fatal("the object was not stored")
+	}
+	if strings.Join(f.calls, ",") != "create big.bin,part big.bin,part big.bin,part big.bin,complete big.bin,tag big.bin" {
+		t.Errorf("unexpected calls %v", f.calls)
+	}
+
+	// The finished upload is gone
+	if ctx = tusRequest(ts, b, "HEAD", "big.bin", tid, nil); ctx.Response.StatusCode() != fasthttp.StatusNotFound {
+		t.Errorf("HEAD of a finished upload gave %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestTusTerminate(t *testing.T) {
+	ts, b, f := newTestTus(t)
+	tid := tusCreate(t, ts, b, "big.bin", 2500)
+	tusRequest(ts, b, "PATCH", "big.bin", tid, make([]byte, 1200), "Upload-Offset", "0")
+
+	ctx := tusRequest(ts, b, "DELETE", "big.bin", tid, nil)
+	if ctx.Response.StatusCode() != fasthttp.StatusNoContent {
+		t.Errorf("DELETE gave %d", ctx.Response.StatusCode())
+	}
+	if strings.Join(f.calls, ",") != "create big.bin,part big.bin,abort big.bin" {
+		t.Errorf("unexpected calls %v", f.calls)
+	}
+	if ctx = tusRequest(ts, b, "HEAD", "big.bin", tid, nil); ctx.Response.StatusCode() != fasthttp.StatusNotFound {
+		t.Errorf("HEAD of a terminated upload gave %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestTusExpire(t *testing.T) {
+	ts, b, f := newTestTus(t)
+	old := tusCreate(t, ts, b, "old.bin", 2500)
+	tusRequest(ts, b, "PATCH", "old.bin", old, make([]byte, 1200), "Upload-Offset", "0")
+	fresh := tusCreate(t, ts, b, "fresh.bin", 2500)
+
+	u, err := ts.load(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Updated = time.Now().Add(-2 * ts.maxAge)
+	ts.save(u)
+
+	ts.expire()
+	if _, err := ts.load(old); err == nil {
+		t.Error("the old upload was kept")
+	}
+	if _, err := ts.load(fresh); err != nil {
+		t.Error("the fresh upload was thrown away:", err)
+	}
+	if f.calls[len(f.calls)-1] != "abort old.bin" {
+		t.Errorf("unexpected calls %v", f.calls)
+	}
+
+	// One which expired before the sweep is gone on the next request
+	u, _ = ts.load(fresh)
+	u.Updated = time.Now().Add(-2 * ts.maxAge)
+	ts.save(u)
+	if ctx := tusRequest(ts, b, "HEAD", "fresh.bin", fresh, nil); ctx.Response.StatusCode() != fasthttp.StatusGone {
+		t.Errorf("HEAD of an expired upload gave %d", ctx.Response.StatusCode())
+	}
+}
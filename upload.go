@@ -1,18 +1,69 @@
 package main
 
 import (
-	"context"
+	"fmt"
 	"io"
+	"log"
+	"time"
 
+	"github.com/araddon/dateparse"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 )
 
 // UploadFile reads from a file and puts the data into an object in a bucket.
-func UploadFile(objectKey string, body io.Reader) (err error) {
-	_, err = s3Client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: &bucketName,
-		Key:    &objectKey,
+func (b *Bucket) UploadFile(objectKey string, body io.Reader) (err error) {
+	_, err = b.S3().PutObject(abortCtx, &s3.PutObjectInput{
+		Bucket: &b.Name,
+		Key:    aws.String(b.key(objectKey)),
 		Body:   body,
 	})
 	return
 }
+
+// The put for an upload to the path, with the content type, Content-Date and
+// Checksum sent by the client.  A checksum which can't be parsed is an error.
+func (b *Bucket) putInput(uri, contentType string, date, checksum []byte) (*s3.PutObjectInput, error) {
+	switch contentType {
+	case "application/x-www-form-urlencoded", "":
+		// Set some sane defaults in case the file has been uploaded with the wrong type
+		contentType = getMime(uri)
+	}
+	in := &s3.PutObjectInput{
+		Bucket:      &b.Name,
+		ContentType: &contentType,
+		Key:         aws.String(b.key(uri)),
+		Metadata:    make(map[string]string),
+	}
+	if len(date) != 0 {
+		if t, err := dateparse.ParseAny(b2s(date)); err == nil {
+			in.Metadata["date"] = t.Format(time.DateTime)
+		}
+	}
+	if len(checksum) != 0 {
+		unmarshalChecksum(checksum, in)
+		if len(in.ChecksumAlgorithm) == 0 {
+			return nil, fmt.Errorf("Invalid checksum formatted string: %q", b2s(checksum))
+		}
+	}
+	return in, nil
+}
+
+// Store the put, in parts when the body is large or of unknown length, a single
+// put is limited to 5G.  The checksum and the size of the object are returned.
+func (b *Bucket) upload(in *s3.PutObjectInput) (string, int64, error) {
+	switch {
+	case in.ContentLength < 0:
+		return b.streamUpload(in)
+	case in.ContentLength > multipartThreshold:
+		return b.multipartUpload(in)
+	}
+	result, err := b.S3().PutObject(abortCtx, in)
+	if debug {
+		log.Printf("Upload result: %#v  err: %v\n", result, err)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	return encodeChecksum(result), in.ContentLength, nil
+}